@@ -1,4 +1,3 @@
 #!/bin/sh
 
-touch /run/docker/plugins/ipvlan.sock
 docker-compose up -d
\ No newline at end of file
@@ -1,15 +1,21 @@
 package ipvlan
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/sdk"
 	"github.com/docker/libnetwork/drivers/remote/api"
+	ipamapi "github.com/docker/libnetwork/ipams/remote/api"
+	"github.com/docker/libnetwork/types"
 )
 
 const (
-	manifest = `{"Implements": ["NetworkDriver"]}`
+	manifest     = `{"Implements": ["NetworkDriver"]}`
+	ipamManifest = `{"Implements": ["NetworkDriver", "IpamDriver"]}`
 	// LocalScope is the correct scope response for a local scope driver
 	LocalScope = `local`
 	// GlobalScope is the correct scope response for a global scope driver
@@ -27,6 +33,15 @@ const (
 	discoverDeletePath = "/NetworkDriver.DiscoverDelete"
 	programExtConnPath = "/NetworkDriver.ProgramExternalConnectivity"
 	revokeExtConnPath  = "/NetworkDriver.RevokeExternalConnectivity"
+	allocateNetPath    = "/NetworkDriver.AllocateNetwork"
+	freeNetPath        = "/NetworkDriver.FreeNetwork"
+
+	ipamCapabilitiesPath = "/IpamDriver.GetCapabilities"
+	addressSpacesPath    = "/IpamDriver.GetDefaultAddressSpaces"
+	requestPoolPath      = "/IpamDriver.RequestPool"
+	releasePoolPath      = "/IpamDriver.ReleasePool"
+	requestAddressPath   = "/IpamDriver.RequestAddress"
+	releaseAddressPath   = "/IpamDriver.ReleaseAddress"
 )
 
 // Driver represent the interface a driver must fulfill.
@@ -43,11 +58,25 @@ type Driver interface {
 	DiscoverDelete(*api.DiscoveryNotification) error
 	ProgramExternalConnectivity(*api.ProgramExternalConnectivityRequest) error
 	RevokeExternalConnectivity(*api.RevokeExternalConnectivityRequest) error
+	AllocateNetwork(*api.AllocateNetworkRequest) (*api.AllocateNetworkResponse, error)
+	FreeNetwork(*api.FreeNetworkRequest) error
+}
+
+// IpamDriver represent the interface a driver must fulfill to also serve as ipam driver.
+type IpamDriver interface {
+	GetIpamCapabilities() (*ipamapi.GetCapabilityResponse, error)
+	GetDefaultAddressSpaces() (*ipamapi.GetAddressSpacesResponse, error)
+	RequestPool(*ipamapi.RequestPoolRequest) (*ipamapi.RequestPoolResponse, error)
+	ReleasePool(*ipamapi.ReleasePoolRequest) error
+	RequestAddress(*ipamapi.RequestAddressRequest) (*ipamapi.RequestAddressResponse, error)
+	ReleaseAddress(*ipamapi.ReleaseAddressRequest) error
 }
 
-// ErrorResponse is a formatted error message that libnetwork can understand
+// ErrorResponse is a formatted error message that libnetwork can understand. Class names the
+// error class the http status of the response is derived from, libnetwork only reads Err
 type ErrorResponse struct {
-	Err string
+	Err   string
+	Class string `json:",omitempty"`
 }
 
 // NewErrorResponse creates an ErrorResponse with the provided message
@@ -59,178 +88,339 @@ func NewErrorResponse(msg string) *ErrorResponse {
 type Handler struct {
 	driver Driver
 	sdk.Handler
+
+	mu          sync.Mutex
+	draining    bool
+	inflight    sync.WaitGroup
+	middlewares []Middleware
+	timeouts    map[string]time.Duration
 }
 
 // NewHandler initializes the request handler with a driver implementation.
+// A driver also implementing IpamDriver is advertised and served as ipam driver.
 func NewHandler(driver Driver) *Handler {
-	h := &Handler{driver, sdk.NewHandler(manifest)}
+	ipam, isIpam := driver.(IpamDriver)
+	m := manifest
+	if isIpam {
+		m = ipamManifest
+	}
+	h := &Handler{driver: driver, Handler: sdk.NewHandler(m), timeouts: make(map[string]time.Duration)}
 	h.initMux()
+	if isIpam {
+		h.initIpamMux(ipam)
+	}
 	return h
 }
 
+// Drain rejects new requests and waits up to timeout for the in-flight driver calls to return.
+func (h *Handler) Drain(timeout time.Duration) error {
+	h.mu.Lock()
+	h.draining = true
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v waiting for in-flight requests", timeout)
+	}
+}
+
+// encodeError writes the error response with the http status of the error class
+func encodeError(w http.ResponseWriter, err error) {
+	status, class := errorStatus(err)
+	w.Header().Set("Content-Type", sdk.DefaultContentTypeV1_1)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{Err: err.Error(), Class: class})
+}
+
+// decodeRequest decodes the json request body, a malformed body is answered as a bad request
+func decodeRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		encodeError(w, types.BadRequestErrorf("failed to decode the %s request: %v", r.URL.Path, err))
+		return false
+	}
+	return true
+}
+
+// handle registers fn wrapped in the middleware chain on the plugin path, tracking it as
+// in-flight while it runs
+func (h *Handler) handle(path string, fn http.HandlerFunc) {
+	h.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if !h.enter() {
+			// the refused requests are counted with the served ones
+			withMetrics(path, func(w http.ResponseWriter, r *http.Request) {
+				encodeError(w, types.NoServiceErrorf("ipvlan plugin is shutting down"))
+			})(w, r)
+			return
+		}
+		defer h.inflight.Done()
+		h.chain(path, fn)(w, r)
+	})
+}
+
+// enter accounts for a new in-flight request unless the handler is draining
+func (h *Handler) enter() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return false
+	}
+	h.inflight.Add(1)
+
+	return true
+}
+
 func (h *Handler) initMux() {
-	h.HandleFunc(capabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+	h.handle(capabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
 		res, err := h.driver.GetCapabilities()
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
 			return
 		}
 		if res == nil {
-			msg := "Network driver must implement GetCapabilities"
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, types.NotImplementedErrorf("Network driver must implement GetCapabilities"))
 			return
 		}
 		sdk.EncodeResponse(w, res, "")
 	})
-	h.HandleFunc(createNetworkPath, func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Entering go-plugins-helpers createnetwork")
+	h.handle(createNetworkPath, func(w http.ResponseWriter, r *http.Request) {
 		req := &api.CreateNetworkRequest{}
-		err := sdk.DecodeRequest(w, r, req)
-		if err != nil {
+		if !decodeRequest(w, r, req) {
 			return
 		}
-		err = h.driver.CreateNetwork(req)
+		err := h.driver.CreateNetwork(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
 			return
 		}
 		sdk.EncodeResponse(w, make(map[string]string), "")
 	})
-	h.HandleFunc(deleteNetworkPath, func(w http.ResponseWriter, r *http.Request) {
+	h.handle(deleteNetworkPath, func(w http.ResponseWriter, r *http.Request) {
 		req := &api.DeleteNetworkRequest{}
-		err := sdk.DecodeRequest(w, r, req)
-		if err != nil {
+		if !decodeRequest(w, r, req) {
 			return
 		}
-		err = h.driver.DeleteNetwork(req)
+		err := h.driver.DeleteNetwork(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
 			return
 		}
 		sdk.EncodeResponse(w, make(map[string]string), "")
 	})
-	h.HandleFunc(createEndpointPath, func(w http.ResponseWriter, r *http.Request) {
+	h.handle(createEndpointPath, func(w http.ResponseWriter, r *http.Request) {
 		req := &api.CreateEndpointRequest{}
-		err := sdk.DecodeRequest(w, r, req)
-		if err != nil {
+		if !decodeRequest(w, r, req) {
 			return
 		}
 		res, err := h.driver.CreateEndpoint(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
+			return
+		}
+		// libnetwork decodes every response, a nil response is answered with an empty one
+		if res == nil {
+			res = &api.CreateEndpointResponse{}
 		}
 		sdk.EncodeResponse(w, res, "")
 	})
-	h.HandleFunc(deleteEndpointPath, func(w http.ResponseWriter, r *http.Request) {
+	h.handle(deleteEndpointPath, func(w http.ResponseWriter, r *http.Request) {
 		req := &api.DeleteEndpointRequest{}
-		err := sdk.DecodeRequest(w, r, req)
-		if err != nil {
+		if !decodeRequest(w, r, req) {
 			return
 		}
-		err = h.driver.DeleteEndpoint(req)
+		err := h.driver.DeleteEndpoint(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
 			return
 		}
 		sdk.EncodeResponse(w, make(map[string]string), "")
 	})
-	h.HandleFunc(endpointInfoPath, func(w http.ResponseWriter, r *http.Request) {
+	h.handle(endpointInfoPath, func(w http.ResponseWriter, r *http.Request) {
 		req := &api.EndpointInfoRequest{}
-		err := sdk.DecodeRequest(w, r, req)
-		if err != nil {
+		if !decodeRequest(w, r, req) {
 			return
 		}
 		res, err := h.driver.EndpointOperInfo(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
+			return
+		}
+		if res == nil {
+			res = &api.EndpointInfoResponse{}
 		}
 		sdk.EncodeResponse(w, res, "")
 	})
-	h.HandleFunc(joinPath, func(w http.ResponseWriter, r *http.Request) {
+	h.handle(joinPath, func(w http.ResponseWriter, r *http.Request) {
 		req := &api.JoinRequest{}
-		err := sdk.DecodeRequest(w, r, req)
-		if err != nil {
+		if !decodeRequest(w, r, req) {
 			return
 		}
 		res, err := h.driver.Join(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
+			return
+		}
+		if res == nil {
+			res = &api.JoinResponse{}
 		}
 		sdk.EncodeResponse(w, res, "")
 	})
-	h.HandleFunc(leavePath, func(w http.ResponseWriter, r *http.Request) {
+	h.handle(leavePath, func(w http.ResponseWriter, r *http.Request) {
 		req := &api.LeaveRequest{}
-		err := sdk.DecodeRequest(w, r, req)
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		err := h.driver.Leave(req)
 		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		sdk.EncodeResponse(w, make(map[string]string), "")
+	})
+	h.handle(discoverNewPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &api.DiscoveryNotification{}
+		if !decodeRequest(w, r, req) {
 			return
 		}
-		err = h.driver.Leave(req)
+		err := h.driver.DiscoverNew(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
 			return
 		}
 		sdk.EncodeResponse(w, make(map[string]string), "")
 	})
-	h.HandleFunc(discoverNewPath, func(w http.ResponseWriter, r *http.Request) {
+	h.handle(discoverDeletePath, func(w http.ResponseWriter, r *http.Request) {
 		req := &api.DiscoveryNotification{}
-		err := sdk.DecodeRequest(w, r, req)
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		err := h.driver.DiscoverDelete(req)
 		if err != nil {
+			encodeError(w, err)
 			return
 		}
-		err = h.driver.DiscoverNew(req)
+		sdk.EncodeResponse(w, make(map[string]string), "")
+	})
+	h.handle(programExtConnPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &api.ProgramExternalConnectivityRequest{}
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		err := h.driver.ProgramExternalConnectivity(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
 			return
 		}
 		sdk.EncodeResponse(w, make(map[string]string), "")
 	})
-	h.HandleFunc(discoverDeletePath, func(w http.ResponseWriter, r *http.Request) {
-		req := &api.DiscoveryNotification{}
-		err := sdk.DecodeRequest(w, r, req)
+	h.handle(revokeExtConnPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &api.RevokeExternalConnectivityRequest{}
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		err := h.driver.RevokeExternalConnectivity(req)
 		if err != nil {
+			encodeError(w, err)
 			return
 		}
-		err = h.driver.DiscoverDelete(req)
+		sdk.EncodeResponse(w, make(map[string]string), "")
+	})
+	h.handle(allocateNetPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &api.AllocateNetworkRequest{}
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		res, err := h.driver.AllocateNetwork(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
+			return
+		}
+		if res == nil {
+			res = &api.AllocateNetworkResponse{}
+		}
+		sdk.EncodeResponse(w, res, "")
+	})
+	h.handle(freeNetPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &api.FreeNetworkRequest{}
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		err := h.driver.FreeNetwork(req)
+		if err != nil {
+			encodeError(w, err)
 			return
 		}
 		sdk.EncodeResponse(w, make(map[string]string), "")
 	})
-	h.HandleFunc(programExtConnPath, func(w http.ResponseWriter, r *http.Request) {
-		req := &api.ProgramExternalConnectivityRequest{}
-		err := sdk.DecodeRequest(w, r, req)
+}
+
+func (h *Handler) initIpamMux(ipam IpamDriver) {
+	h.handle(ipamCapabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+		res, err := ipam.GetIpamCapabilities()
 		if err != nil {
+			encodeError(w, err)
 			return
 		}
-		err = h.driver.ProgramExternalConnectivity(req)
+		sdk.EncodeResponse(w, res, "")
+	})
+	h.handle(addressSpacesPath, func(w http.ResponseWriter, r *http.Request) {
+		res, err := ipam.GetDefaultAddressSpaces()
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		sdk.EncodeResponse(w, res, "")
+	})
+	h.handle(requestPoolPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ipamapi.RequestPoolRequest{}
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		res, err := ipam.RequestPool(req)
+		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		sdk.EncodeResponse(w, res, "")
+	})
+	h.handle(releasePoolPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ipamapi.ReleasePoolRequest{}
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		err := ipam.ReleasePool(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
 			return
 		}
 		sdk.EncodeResponse(w, make(map[string]string), "")
 	})
-	h.HandleFunc(revokeExtConnPath, func(w http.ResponseWriter, r *http.Request) {
-		req := &api.RevokeExternalConnectivityRequest{}
-		err := sdk.DecodeRequest(w, r, req)
+	h.handle(requestAddressPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ipamapi.RequestAddressRequest{}
+		if !decodeRequest(w, r, req) {
+			return
+		}
+		res, err := ipam.RequestAddress(req)
 		if err != nil {
+			encodeError(w, err)
+			return
+		}
+		sdk.EncodeResponse(w, res, "")
+	})
+	h.handle(releaseAddressPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &ipamapi.ReleaseAddressRequest{}
+		if !decodeRequest(w, r, req) {
 			return
 		}
-		err = h.driver.RevokeExternalConnectivity(req)
+		err := ipam.ReleaseAddress(req)
 		if err != nil {
-			msg := err.Error()
-			sdk.EncodeResponse(w, NewErrorResponse(msg), msg)
+			encodeError(w, err)
 			return
 		}
 		sdk.EncodeResponse(w, make(map[string]string), "")
@@ -0,0 +1,465 @@
+package ipvlan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/types"
+)
+
+// fakeDriver records the requests it is handed and answers with its canned responses, or
+// with err when set
+type fakeDriver struct {
+	mu       sync.Mutex
+	err      error
+	requests []interface{}
+	caps     *api.GetCapabilityResponse
+	endpoint *api.CreateEndpointResponse
+	info     *api.EndpointInfoResponse
+	join     *api.JoinResponse
+	alloc    *api.AllocateNetworkResponse
+}
+
+func (d *fakeDriver) record(req interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests = append(d.requests, req)
+	return d.err
+}
+
+func (d *fakeDriver) recorded() []interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.requests
+}
+
+func (d *fakeDriver) GetCapabilities() (*api.GetCapabilityResponse, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.caps, nil
+}
+
+func (d *fakeDriver) CreateNetwork(r *api.CreateNetworkRequest) error {
+	return d.record(r)
+}
+
+func (d *fakeDriver) DeleteNetwork(r *api.DeleteNetworkRequest) error {
+	return d.record(r)
+}
+
+func (d *fakeDriver) CreateEndpoint(r *api.CreateEndpointRequest) (*api.CreateEndpointResponse, error) {
+	if err := d.record(r); err != nil {
+		return nil, err
+	}
+	return d.endpoint, nil
+}
+
+func (d *fakeDriver) DeleteEndpoint(r *api.DeleteEndpointRequest) error {
+	return d.record(r)
+}
+
+func (d *fakeDriver) EndpointOperInfo(r *api.EndpointInfoRequest) (*api.EndpointInfoResponse, error) {
+	if err := d.record(r); err != nil {
+		return nil, err
+	}
+	return d.info, nil
+}
+
+func (d *fakeDriver) Join(r *api.JoinRequest) (*api.JoinResponse, error) {
+	if err := d.record(r); err != nil {
+		return nil, err
+	}
+	return d.join, nil
+}
+
+func (d *fakeDriver) Leave(r *api.LeaveRequest) error {
+	return d.record(r)
+}
+
+func (d *fakeDriver) DiscoverNew(r *api.DiscoveryNotification) error {
+	return d.record(r)
+}
+
+func (d *fakeDriver) DiscoverDelete(r *api.DiscoveryNotification) error {
+	return d.record(r)
+}
+
+func (d *fakeDriver) ProgramExternalConnectivity(r *api.ProgramExternalConnectivityRequest) error {
+	return d.record(r)
+}
+
+func (d *fakeDriver) RevokeExternalConnectivity(r *api.RevokeExternalConnectivityRequest) error {
+	return d.record(r)
+}
+
+func (d *fakeDriver) AllocateNetwork(r *api.AllocateNetworkRequest) (*api.AllocateNetworkResponse, error) {
+	if err := d.record(r); err != nil {
+		return nil, err
+	}
+	return d.alloc, nil
+}
+
+func (d *fakeDriver) FreeNetwork(r *api.FreeNetworkRequest) error {
+	return d.record(r)
+}
+
+// serveTestHandler serves the handler on a local listener, it returns the handler url and
+// a function stopping the listener
+func serveTestHandler(h *Handler) (string, func()) {
+	srv := httptest.NewUnstartedServer(nil)
+	go h.Serve(srv.Listener)
+
+	return "http://" + srv.Listener.Addr().String(), func() { srv.Listener.Close() }
+}
+
+// postTestBody posts the raw body to the plugin path and returns the response
+func postTestBody(t *testing.T, url, path, body string) (int, []byte) {
+	res, err := http.Post(url+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+
+	return res.StatusCode, b
+}
+
+// postTestRequest posts the json encoded request to the plugin path and returns the response
+func postTestRequest(t *testing.T, url, path string, req interface{}) (int, []byte) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return postTestBody(t, url, path, string(b))
+}
+
+// decodeSingle decodes a body holding exactly one json document
+func decodeSingle(t *testing.T, path string, body []byte, v interface{}) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := dec.Decode(v); err != nil {
+		t.Fatalf("%s: invalid response body %q: %v", path, body, err)
+	}
+	if dec.More() {
+		t.Fatalf("%s: expected a single response, got %q", path, body)
+	}
+}
+
+// expectErrorResponse checks the response is a single error body of the status and class
+func expectErrorResponse(t *testing.T, path string, status int, body []byte, expected error, expectedStatus int, class string) {
+	if status != expectedStatus {
+		t.Fatalf("%s: expected status %d for %v, got %d", path, expectedStatus, expected, status)
+	}
+	var res ErrorResponse
+	decodeSingle(t, path, body, &res)
+	if res.Err != expected.Error() || res.Class != class {
+		t.Fatalf("%s: expected error %q of class %s, got %q of class %s", path, expected, class, res.Err, res.Class)
+	}
+}
+
+// containsJSON checks every field of the want object is in the got object with the same
+// value, libnetwork ignores the other fields
+func containsJSON(got, want interface{}) bool {
+	w, ok := want.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(got, want)
+	}
+	g, ok := got.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for k, v := range w {
+		if !containsJSON(g[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// expectJSONFields checks the successful response holds the fields of the expected object
+func expectJSONFields(t *testing.T, path string, body []byte, expected string) {
+	var want, got map[string]interface{}
+	if err := json.Unmarshal([]byte(expected), &want); err != nil {
+		t.Fatal(err)
+	}
+	decodeSingle(t, path, body, &got)
+	if e, ok := got["Err"]; ok && e != "" {
+		t.Fatalf("%s: unexpected error %v in a successful response", path, e)
+	}
+	if !containsJSON(got, want) {
+		t.Fatalf("%s: expected the fields of %s in the response, got %q", path, expected, body)
+	}
+}
+
+// driverPaths are the NetworkDriver paths decoding a request
+var driverPaths = []string{
+	createNetworkPath, deleteNetworkPath, createEndpointPath, endpointInfoPath, deleteEndpointPath,
+	joinPath, leavePath, discoverNewPath, discoverDeletePath, programExtConnPath, revokeExtConnPath,
+	allocateNetPath, freeNetPath,
+}
+
+// TestHandlerContract tests every NetworkDriver path decodes its request and answers with
+// the json libnetwork expects
+func TestHandlerContract(t *testing.T) {
+	generic := map[string]interface{}{"com.docker.network.generic": map[string]interface{}{"parent": "eth0"}}
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		driver   *fakeDriver
+		request  interface{} // expected decoded request, nil for none
+		response string      // fields expected in the response
+	}{
+		{
+			name:     "capabilities",
+			path:     capabilitiesPath,
+			driver:   &fakeDriver{caps: &api.GetCapabilityResponse{Scope: LocalScope}},
+			response: `{"Scope": "local"}`,
+		},
+		{
+			name:     "create network",
+			path:     createNetworkPath,
+			body:     `{"NetworkID": "n1", "Options": {"com.docker.network.generic": {"parent": "eth0"}}}`,
+			request:  &api.CreateNetworkRequest{NetworkID: "n1", Options: generic},
+			response: `{}`,
+		},
+		{
+			name:     "delete network",
+			path:     deleteNetworkPath,
+			body:     `{"NetworkID": "n1"}`,
+			request:  &api.DeleteNetworkRequest{NetworkID: "n1"},
+			response: `{}`,
+		},
+		{
+			name:   "create endpoint",
+			path:   createEndpointPath,
+			body:   `{"NetworkID": "n1", "EndpointID": "e1", "Interface": {"Address": "10.0.0.2/24"}}`,
+			driver: &fakeDriver{endpoint: &api.CreateEndpointResponse{}},
+			request: &api.CreateEndpointRequest{
+				NetworkID:  "n1",
+				EndpointID: "e1",
+				Interface:  &api.EndpointInterface{Address: "10.0.0.2/24"},
+			},
+			response: `{"Interface": null}`,
+		},
+		{
+			name:     "create endpoint with a driver address",
+			path:     createEndpointPath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1", "Interface": {}}`,
+			driver:   &fakeDriver{endpoint: &api.CreateEndpointResponse{Interface: &api.EndpointInterface{Address: "10.0.0.3/24"}}},
+			request:  &api.CreateEndpointRequest{NetworkID: "n1", EndpointID: "e1", Interface: &api.EndpointInterface{}},
+			response: `{"Interface": {"Address": "10.0.0.3/24"}}`,
+		},
+		{
+			name:     "create endpoint with a nil response",
+			path:     createEndpointPath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1"}`,
+			request:  &api.CreateEndpointRequest{NetworkID: "n1", EndpointID: "e1"},
+			response: `{"Interface": null}`,
+		},
+		{
+			name:     "endpoint info",
+			path:     endpointInfoPath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1"}`,
+			driver:   &fakeDriver{info: &api.EndpointInfoResponse{Value: map[string]interface{}{"SrcName": "ipv1234"}}},
+			request:  &api.EndpointInfoRequest{NetworkID: "n1", EndpointID: "e1"},
+			response: `{"Value": {"SrcName": "ipv1234"}}`,
+		},
+		{
+			name:     "endpoint info with a nil response",
+			path:     endpointInfoPath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1"}`,
+			request:  &api.EndpointInfoRequest{NetworkID: "n1", EndpointID: "e1"},
+			response: `{"Value": null}`,
+		},
+		{
+			name:     "delete endpoint",
+			path:     deleteEndpointPath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1"}`,
+			request:  &api.DeleteEndpointRequest{NetworkID: "n1", EndpointID: "e1"},
+			response: `{}`,
+		},
+		{
+			name: "join",
+			path: joinPath,
+			body: `{"NetworkID": "n1", "EndpointID": "e1", "SandboxKey": "/var/run/docker/netns/1"}`,
+			driver: &fakeDriver{join: &api.JoinResponse{
+				InterfaceName: &api.InterfaceName{SrcName: "ipv1234", DstPrefix: "eth"},
+				Gateway:       "10.0.0.1",
+				StaticRoutes:  []api.StaticRoute{{Destination: "10.1.0.0/16", RouteType: types.NEXTHOP, NextHop: "10.0.0.254"}},
+			}},
+			request: &api.JoinRequest{NetworkID: "n1", EndpointID: "e1", SandboxKey: "/var/run/docker/netns/1"},
+			response: `{
+				"InterfaceName": {"SrcName": "ipv1234", "DstPrefix": "eth"},
+				"Gateway": "10.0.0.1",
+				"GatewayIPv6": "",
+				"StaticRoutes": [{"Destination": "10.1.0.0/16", "RouteType": 0, "NextHop": "10.0.0.254"}],
+				"DisableGatewayService": false
+			}`,
+		},
+		{
+			name:     "join with a nil response",
+			path:     joinPath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1"}`,
+			request:  &api.JoinRequest{NetworkID: "n1", EndpointID: "e1"},
+			response: `{"InterfaceName": null, "Gateway": "", "StaticRoutes": null}`,
+		},
+		{
+			name:     "leave",
+			path:     leavePath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1"}`,
+			request:  &api.LeaveRequest{NetworkID: "n1", EndpointID: "e1"},
+			response: `{}`,
+		},
+		{
+			name:     "discover new",
+			path:     discoverNewPath,
+			body:     `{"DiscoveryType": 1, "DiscoveryData": {"Address": "10.0.0.5"}}`,
+			request:  &api.DiscoveryNotification{DiscoveryType: 1, DiscoveryData: map[string]interface{}{"Address": "10.0.0.5"}},
+			response: `{}`,
+		},
+		{
+			name:     "discover delete",
+			path:     discoverDeletePath,
+			body:     `{"DiscoveryType": 1}`,
+			request:  &api.DiscoveryNotification{DiscoveryType: 1},
+			response: `{}`,
+		},
+		{
+			name:     "program external connectivity",
+			path:     programExtConnPath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1"}`,
+			request:  &api.ProgramExternalConnectivityRequest{NetworkID: "n1", EndpointID: "e1"},
+			response: `{}`,
+		},
+		{
+			name:     "revoke external connectivity",
+			path:     revokeExtConnPath,
+			body:     `{"NetworkID": "n1", "EndpointID": "e1"}`,
+			request:  &api.RevokeExternalConnectivityRequest{NetworkID: "n1", EndpointID: "e1"},
+			response: `{}`,
+		},
+		{
+			name:     "allocate network",
+			path:     allocateNetPath,
+			body:     `{"NetworkID": "n1", "Options": {"parent": "eth0"}}`,
+			driver:   &fakeDriver{alloc: &api.AllocateNetworkResponse{Options: map[string]string{driverModeOpt: modeL2}}},
+			request:  &api.AllocateNetworkRequest{NetworkID: "n1", Options: map[string]string{"parent": "eth0"}},
+			response: `{"Options": {"ipvlan_mode": "l2"}}`,
+		},
+		{
+			name:     "free network",
+			path:     freeNetPath,
+			body:     `{"NetworkID": "n1"}`,
+			request:  &api.FreeNetworkRequest{NetworkID: "n1"},
+			response: `{}`,
+		},
+	}
+	for _, tt := range tests {
+		d := tt.driver
+		if d == nil {
+			d = &fakeDriver{}
+		}
+		url, stop := serveTestHandler(NewHandler(d))
+		status, body := postTestBody(t, url, tt.path, tt.body)
+		stop()
+		if status != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %q", tt.name, status, body)
+		}
+		expectJSONFields(t, tt.path, body, tt.response)
+		requests := d.recorded()
+		if tt.request == nil {
+			continue
+		}
+		if len(requests) != 1 || !reflect.DeepEqual(requests[0], tt.request) {
+			t.Fatalf("%s: expected the driver to be handed %+v, got %+v", tt.name, tt.request, requests)
+		}
+	}
+}
+
+// TestHandlerMalformedRequests tests malformed bodies are answered as bad requests without
+// calling the driver
+func TestHandlerMalformedRequests(t *testing.T) {
+	d := &fakeDriver{}
+	url, stop := serveTestHandler(NewHandler(d))
+	defer stop()
+	for _, path := range driverPaths {
+		for _, body := range []string{`{"NetworkID":`, `[]`, ``} {
+			status, b := postTestBody(t, url, path, body)
+			if status != http.StatusBadRequest {
+				t.Fatalf("%s: expected status 400 for body %q, got %d", path, body, status)
+			}
+			var res ErrorResponse
+			decodeSingle(t, path, b, &res)
+			if res.Err == "" || res.Class != errClassBadRequest {
+				t.Fatalf("%s: unexpected error response %q for body %q", path, b, body)
+			}
+		}
+	}
+	if requests := d.recorded(); len(requests) != 0 {
+		t.Fatalf("the driver was called with malformed requests: %+v", requests)
+	}
+}
+
+// TestHandlerNilCapabilities tests a driver without capabilities is reported as an error
+func TestHandlerNilCapabilities(t *testing.T) {
+	url, stop := serveTestHandler(NewHandler(&fakeDriver{}))
+	defer stop()
+	status, body := postTestBody(t, url, capabilitiesPath, `{}`)
+	expectErrorResponse(t, capabilitiesPath, status, body, types.NotImplementedErrorf("Network driver must implement GetCapabilities"),
+		http.StatusNotImplemented, errClassNotImplemented)
+}
+
+// TestHandlerErrorStatus tests the driver errors are answered with the status of their class
+func TestHandlerErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		class  string
+	}{
+		{types.BadRequestErrorf("invalid mtu"), http.StatusBadRequest, errClassBadRequest},
+		{types.ForbiddenErrorf("reservation is held"), http.StatusForbidden, errClassForbidden},
+		{types.NotFoundErrorf("parent interface eth9 was not found"), http.StatusNotFound, errClassNotFound},
+		{conflictErrorf("network already exists"), http.StatusConflict, errClassConflict},
+		{types.NotImplementedErrorf("kernel too old"), http.StatusNotImplemented, errClassNotImplemented},
+		{types.NoServiceErrorf("no dhcp server"), http.StatusServiceUnavailable, errClassRetry},
+		{types.InternalErrorf("netlink failure"), http.StatusInternalServerError, errClassInternal},
+		{errors.New("unclassified failure"), http.StatusInternalServerError, errClassInternal},
+	}
+	for _, tt := range tests {
+		url, stop := serveTestHandler(NewHandler(&fakeDriver{err: tt.err}))
+		status, body := postTestBody(t, url, capabilitiesPath, `{}`)
+		expectErrorResponse(t, capabilitiesPath, status, body, tt.err, tt.status, tt.class)
+		for _, path := range driverPaths {
+			status, body := postTestBody(t, url, path, `{"NetworkID": "n1", "EndpointID": "e1"}`)
+			expectErrorResponse(t, path, status, body, tt.err, tt.status, tt.class)
+		}
+		stop()
+	}
+}
+
+// TestHandlerDraining tests a draining handler asks the clients to retry
+func TestHandlerDraining(t *testing.T) {
+	h := NewHandler(&fakeDriver{})
+	url, stop := serveTestHandler(h)
+	defer stop()
+	if err := h.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	status, body := postTestRequest(t, url, createNetworkPath, &api.CreateNetworkRequest{NetworkID: testNetworkID})
+	expectErrorResponse(t, createNetworkPath, status, body, types.NoServiceErrorf("ipvlan plugin is shutting down"),
+		http.StatusServiceUnavailable, errClassRetry)
+}
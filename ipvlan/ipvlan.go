@@ -7,7 +7,6 @@ import (
 	"github.com/docker/libnetwork/datastore"
 	"github.com/docker/libnetwork/driverapi"
 	"github.com/docker/libnetwork/osl"
-	"github.com/docker/libnetwork/types"
 	"github.com/docker/libnetwork/drivers/remote/api"
 )
 
@@ -18,15 +17,28 @@ const (
 	ipvlanType          = "ipvlan" // driver type name
 	modeL2              = "l2"     // ipvlan mode l2 is the default
 	modeL3              = "l3"     // ipvlan L3 mode
+	modeL3S             = "l3s"    // ipvlan L3 mode with netfilter/conntrack hooks
 	parentOpt           = "parent" // parent interface -o parent
 	modeOpt             = "_mode"  // ipvlan mode ux opt suffix
+	flagOpt             = "_flag"  // ipvlan flag ux opt suffix
+	mtuOpt              = "mtu"    // link mtu -o mtu, alias of com.docker.network.driver.mtu
+	routesOpt           = "routes" // static routes of the endpoints -o routes
 
 	// add by Min
 	gatewayOpt          = "gateway"
 	subnetOpt           = "subnet"
 )
 
-var driverModeOpt = ipvlanType + modeOpt // mode -o ipvlan_mode
+const (
+	flagBridge  = "bridge"  // ipvlan bridge flag is the default
+	flagPrivate = "private" // ipvlan private flag, slaves can not talk to each other
+	flagVepa    = "vepa"    // ipvlan vepa flag, slave traffic is hairpinned by the upstream switch
+)
+
+var (
+	driverModeOpt = ipvlanType + modeOpt // mode -o ipvlan_mode
+	driverFlagOpt = ipvlanType + flagOpt // flag -o ipvlan_flag
+)
 
 type endpointTable map[string]*endpoint
 
@@ -34,20 +46,33 @@ type networkTable map[string]*network
 
 type driver struct {
 	networks networkTable
+	scope    string
 	sync.Once
 	sync.Mutex
-	store datastore.DataStore
+	store        datastore.DataStore
+	globalStore  datastore.DataStore
+	ipamMu       sync.Mutex
+	pools        map[string]*ipamPool // ipam pools when no store is configured
+	leaseMu      sync.Mutex
+	leases       map[string]*dhcpLease // dhcp leases by endpoint id
+	announcer    routeAnnouncer        // exports the l3 endpoint prefixes, nil when disabled
+	resMu        sync.Mutex
+	reservations map[string]*reservation // address reservations by network id and name
+	unrestored   map[string]bool         // ids of stored networks that failed to restore
+	linkMu       sync.RWMutex            // held by joins and leaves, locked by the admin link repairs
 }
 
 type endpoint struct {
-	id       string
-	nid      string
-	mac      net.HardwareAddr
-	addr     *net.IPNet
-	addrv6   *net.IPNet
-	srcName  string
-	dbIndex  uint64
-	dbExists bool
+	id          string
+	nid         string
+	mac         net.HardwareAddr
+	addr        *net.IPNet
+	addrv6      *net.IPNet
+	srcName     string
+	ifIndex     int
+	reservation string // name of the address reservation held by the endpoint
+	dbIndex     uint64
+	dbExists    bool
 }
 
 type network struct {
@@ -59,27 +84,50 @@ type network struct {
 	sync.Mutex
 }
 
-func NewDriver() (*driver) {
-	return &driver{
-		networks: networkTable{},
+// NewDriver initializes the ipvlan driver and restores the networks and
+// endpoints persisted in the datastore passed through the driver options
+func NewDriver(config map[string]interface{}) (*driver, error) {
+	d := &driver{
+		networks:     networkTable{},
+		scope:        LocalScope,
+		pools:        map[string]*ipamPool{},
+		leases:       map[string]*dhcpLease{},
+		reservations: map[string]*reservation{},
+		unrestored:   map[string]bool{},
+	}
+	if c, ok := config[BGPOption].(*BGPConfig); ok {
+		s, err := newBGPSpeaker(c)
+		if err != nil {
+			return nil, err
+		}
+		d.announcer = s
+	}
+	if err := d.initStore(config); err != nil {
+		d.Close()
+		return nil, err
 	}
-	// TODO: d.initStore(config)
-}
-
-func (d *driver) NetworkAllocate(id string, option map[string]string, ipV4Data, ipV6Data []driverapi.IPAMData) (map[string]string, error) {
-	return nil, types.NotImplementedErrorf("not implemented")
-}
 
-func (d *driver) NetworkFree(id string) error {
-	return types.NotImplementedErrorf("not implemented")
+	return d, nil
 }
 
 func (driver *driver) GetCapabilities() (*api.GetCapabilityResponse, error) {
-	return &api.GetCapabilityResponse{ Scope: "local"}, nil
+	return &api.GetCapabilityResponse{ Scope: driver.scope}, nil
 }
 
-func (d *driver) EndpointOperInfo(*api.EndpointInfoRequest) (*api.EndpointInfoResponse, error) {
-	return &api.EndpointInfoResponse{Value: make(map[string]interface{}, 0)}, nil
+// Close releases the datastores and the route announcer of the driver once no more
+// requests are served
+func (d *driver) Close() error {
+	if d.announcer != nil {
+		d.announcer.Close()
+	}
+	if d.store != nil {
+		d.store.Close()
+	}
+	if d.globalStore != nil {
+		d.globalStore.Close()
+	}
+
+	return nil
 }
 
 func (d *driver) Type() string {
@@ -0,0 +1,257 @@
+package ipvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/osl"
+	"github.com/docker/libnetwork/types"
+)
+
+// The admin api inspects and repairs the driver state. It is only served by
+// NewAdminHandler on its own socket, the plugin Handler never routes these paths:
+//
+//	GET    /networks                              networks, endpoints and link status
+//	GET    /networks/<nid>                        a single network
+//	POST   /networks/<nid>/parent                 re-create a missing parent link
+//	GET    /endpoints                             endpoints of every network
+//	DELETE /networks/<nid>/endpoints/<eid>        forget an endpoint docker no longer knows
+//	DELETE /links/orphans                         delete slave links not bound to an endpoint
+
+// linkStatus is the state of a link in the host namespace. Endpoint links move into the
+// container namespace on join and are then not found on the host
+type linkStatus struct {
+	Name   string
+	Exists bool
+	Index  int    `json:",omitempty"`
+	Type   string `json:",omitempty"`
+	Up     bool
+	Mtu    int `json:",omitempty"`
+}
+
+type adminEndpoint struct {
+	ID        string
+	NetworkID string
+	Config    *endpoint
+	Link      linkStatus
+}
+
+type adminNetwork struct {
+	ID        string
+	Config    *configuration
+	Parent    linkStatus
+	Endpoints []*adminEndpoint
+}
+
+type adminAPI struct {
+	d *driver
+}
+
+// NewAdminHandler serves the admin api of the driver
+func NewAdminHandler(d *driver) http.Handler {
+	return &adminAPI{d: d}
+}
+
+// NewAdminListener listens on the unix socket of the admin api, readable by root only. The
+// socket is refused anywhere under the plugin directory, docker scans it and its
+// subdirectories for plugin sockets
+func NewAdminListener(path string) (net.Listener, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin socket %s: %v", path, err)
+	}
+	dir, err := resolvePath(filepath.Dir(abs))
+	if err != nil {
+		return nil, err
+	}
+	pluginDir, err := resolvePath(pluginSockDir)
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(pluginDir, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("admin socket %s must not be under the plugin directory %s", path, pluginSockDir)
+	}
+
+	return NewUnixListener(abs, "root")
+}
+
+// resolvePath resolves the symlinks of the longest existing prefix of the absolute path,
+// the missing directories are created later
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to resolve %s: %v", path, err)
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolved, err = resolvePath(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer osl.InitOSContext()()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "networks":
+		a.networks(w)
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "networks":
+		a.network(w, parts[1])
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "networks" && parts[2] == "parent":
+		a.repairParent(w, parts[1])
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "endpoints":
+		a.endpoints(w)
+	case r.Method == "DELETE" && len(parts) == 4 && parts[0] == "networks" && parts[2] == "endpoints":
+		a.forgetEndpoint(w, parts[1], parts[3])
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "links" && parts[1] == "orphans":
+		a.deleteOrphans(w)
+	default:
+		encodeError(w, types.NotFoundErrorf("unknown admin operation %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (a *adminAPI) networks(w http.ResponseWriter) {
+	networks := a.d.getNetworks()
+	sort.Slice(networks, func(i, j int) bool { return networks[i].id < networks[j].id })
+	res := make([]*adminNetwork, 0, len(networks))
+	for _, n := range networks {
+		res = append(res, networkStatus(n))
+	}
+	writeJSON(w, res)
+}
+
+func (a *adminAPI) network(w http.ResponseWriter, nid string) {
+	n, err := a.d.getNetwork(nid)
+	if err != nil {
+		encodeError(w, err)
+		return
+	}
+	writeJSON(w, networkStatus(n))
+}
+
+func (a *adminAPI) endpoints(w http.ResponseWriter) {
+	res := []*adminEndpoint{}
+	for _, n := range a.d.getNetworks() {
+		res = append(res, networkStatus(n).Endpoints...)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	writeJSON(w, res)
+}
+
+// repairParent re-creates the parent link of the network when it was deleted from the host
+func (a *adminAPI) repairParent(w http.ResponseWriter, nid string) {
+	n, err := a.d.getNetwork(nid)
+	if err != nil {
+		encodeError(w, err)
+		return
+	}
+	if err := a.d.createParent(n); err != nil {
+		encodeError(w, err)
+		return
+	}
+	writeJSON(w, networkStatus(n))
+}
+
+// forgetEndpoint drops an endpoint left behind by a failed docker operation
+func (a *adminAPI) forgetEndpoint(w http.ResponseWriter, nid, eid string) {
+	n, err := a.d.getNetwork(nid)
+	if err != nil {
+		encodeError(w, err)
+		return
+	}
+	ep := n.endpoint(eid)
+	if ep == nil {
+		encodeError(w, types.NotFoundErrorf("endpoint id %q not found", eid))
+		return
+	}
+	// keep a join or leave of the endpoint from binding or deleting its link meanwhile
+	a.d.linkMu.Lock()
+	a.d.forgetEndpoint(n, ep)
+	a.d.linkMu.Unlock()
+	writeJSON(w, endpointStatus(ep))
+}
+
+func (a *adminAPI) deleteOrphans(w http.ResponseWriter) {
+	// a join creates its slave link before binding it to the endpoint, keep the joins and
+	// leaves out while the unbound links are deleted
+	a.d.linkMu.Lock()
+	deleted, err := a.d.deleteOrphanLinks()
+	a.d.linkMu.Unlock()
+	if err != nil {
+		encodeError(w, err)
+		return
+	}
+	if deleted == nil {
+		deleted = []string{}
+	}
+	writeJSON(w, map[string][]string{"Deleted": deleted})
+}
+
+func networkStatus(n *network) *adminNetwork {
+	n.Lock()
+	endpoints := make([]*endpoint, 0, len(n.endpoints))
+	for _, ep := range n.endpoints {
+		endpoints = append(endpoints, ep)
+	}
+	n.Unlock()
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].id < endpoints[j].id })
+
+	res := &adminNetwork{
+		ID:        n.id,
+		Config:    n.config,
+		Parent:    getLinkStatus(n.config.Parent),
+		Endpoints: make([]*adminEndpoint, 0, len(endpoints)),
+	}
+	for _, ep := range endpoints {
+		res.Endpoints = append(res.Endpoints, endpointStatus(ep))
+	}
+	return res
+}
+
+func endpointStatus(ep *endpoint) *adminEndpoint {
+	return &adminEndpoint{
+		ID:        ep.id,
+		NetworkID: ep.nid,
+		Config:    ep,
+		Link:      getLinkStatus(ep.srcName),
+	}
+}
+
+// getLinkStatus looks the link up in the host namespace
+func getLinkStatus(name string) linkStatus {
+	status := linkStatus{Name: name}
+	if name == "" {
+		return status
+	}
+	link, err := ns.NlHandle().LinkByName(name)
+	if err != nil {
+		return status
+	}
+	attrs := link.Attrs()
+	status.Exists = true
+	status.Index = attrs.Index
+	status.Type = link.Type()
+	status.Up = attrs.Flags&net.FlagUp != 0
+	status.Mtu = attrs.MTU
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
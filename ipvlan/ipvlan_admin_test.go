@@ -0,0 +1,127 @@
+package ipvlan
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/testutils"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path string, res interface{}) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	if res != nil && rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(res); err != nil {
+			t.Fatalf("%s %s: invalid response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// TestAdminAPI tests the admin api reports and repairs the driver state
+func TestAdminAPI(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	d, err := NewDriver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "192.168.90.0/24", nil)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.90.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	h := NewAdminHandler(d)
+
+	var networks []adminNetwork
+	if status := adminRequest(t, h, "GET", "/networks", &networks); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+	}
+	if len(networks) != 1 || networks[0].ID != testNetworkID || len(networks[0].Endpoints) != 1 {
+		t.Fatalf("unexpected networks %+v", networks)
+	}
+	parent := networks[0].Parent
+	if !parent.Exists || !parent.Up || parent.Type != "dummy" {
+		t.Fatalf("expected the dummy parent link up, got %+v", parent)
+	}
+
+	// the deleted parent link is re-created
+	link, err := ns.NlHandle().LinkByName(parent.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.NlHandle().LinkDel(link); err != nil {
+		t.Fatal(err)
+	}
+	var network adminNetwork
+	if status := adminRequest(t, h, "POST", "/networks/"+testNetworkID+"/parent", &network); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+	}
+	if !network.Parent.Exists {
+		t.Fatalf("expected the parent link re-created, got %+v", network.Parent)
+	}
+
+	if status := adminRequest(t, h, "DELETE", "/networks/"+testNetworkID+"/endpoints/"+testEndpointID, nil); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+	}
+	var endpoints []adminEndpoint
+	adminRequest(t, h, "GET", "/endpoints", &endpoints)
+	if len(endpoints) != 0 {
+		t.Fatalf("expected the endpoint to be forgotten, got %+v", endpoints)
+	}
+	if status := adminRequest(t, h, "DELETE", "/networks/"+testNetworkID+"/endpoints/"+testEndpointID, nil); status != http.StatusNotFound {
+		t.Fatalf("expected status %d for an unknown endpoint, got %d", http.StatusNotFound, status)
+	}
+	if status := adminRequest(t, h, "GET", "/NetworkDriver.GetCapabilities", nil); status != http.StatusNotFound {
+		t.Fatalf("expected status %d for a plugin path, got %d", http.StatusNotFound, status)
+	}
+}
+
+// TestAdminListenerOutsidePluginDir tests the admin socket is refused under the plugin
+// directory, including its subdirectories and symlinks to it
+func TestAdminListenerOutsidePluginDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvlan-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { pluginSockDir = orig }(pluginSockDir)
+	pluginSockDir = filepath.Join(dir, "run", "plugins")
+	if err := os.MkdirAll(pluginSockDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "plugins")
+	if err := os.Symlink(pluginSockDir, link); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(pluginSockDir, "ipvlan-admin.sock"),
+		filepath.Join(pluginSockDir, "admin", "ipvlan-admin.sock"),
+		filepath.Join(link, "ipvlan-admin.sock"),
+		filepath.Join(link, "admin", "ipvlan-admin.sock"),
+	} {
+		if l, err := NewAdminListener(path); err == nil {
+			l.Close()
+			t.Fatalf("expected an error for the admin socket %s", path)
+		}
+	}
+	l, err := NewAdminListener(filepath.Join(dir, "admin", "ipvlan-admin.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen outside of the plugin directory: %v", err)
+	}
+	l.Close()
+}
@@ -0,0 +1,519 @@
+package ipvlan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/osl"
+	"github.com/docker/libnetwork/types"
+)
+
+// BGPOption is the driver option holding the *BGPConfig of the built-in bgp speaker
+const BGPOption = "ipvlan.bgp"
+
+const (
+	bgpPort           = "179"
+	bgpVersion        = 4
+	bgpHeaderLen      = 19
+	bgpMaxMessageLen  = 4096
+	bgpMaxPrefixes    = 500 // host prefixes per update, well below the message size limit
+	bgpHoldTime       = 90 * time.Second
+	bgpConnectTimeout = 10 * time.Second
+	bgpRetryInterval  = 15 * time.Second
+	bgpASTrans        = 23456 // stands in for a 4-octet as in 2-octet fields
+
+	bgpMsgOpen         = 1
+	bgpMsgUpdate       = 2
+	bgpMsgNotification = 3
+	bgpMsgKeepalive    = 4
+
+	bgpAttrFlagTransitive = 0x40
+	bgpAttrFlagExtended   = 0x10
+	bgpAttrOrigin         = 1
+	bgpAttrASPath         = 2
+	bgpAttrNextHop        = 3
+	bgpAttrLocalPref      = 5
+	bgpOriginIGP          = 0
+	bgpASSequence         = 2
+	bgpLocalPref          = 100
+
+	bgpOptParamCapability = 2
+	bgpCapMultiprotocol   = 1
+	bgpCapAS4             = 65
+)
+
+// BGPConfig configures the built-in bgp speaker announcing the l3 and l3s endpoint prefixes
+type BGPConfig struct {
+	LocalAS  uint32
+	RouterID net.IP
+	NextHop  net.IP // next hop of the announced prefixes, defaults to the router id
+	Peers    []BGPPeer
+}
+
+// BGPPeer is a bgp neighbor of the speaker
+type BGPPeer struct {
+	Address string // host:port of the peer
+	AS      uint32
+}
+
+// ParseBGPPeer parses a peer formatted as <as>@<address>[:port]
+func ParseBGPPeer(s string) (BGPPeer, error) {
+	parts := strings.SplitN(s, "@", 2)
+	if len(parts) != 2 {
+		return BGPPeer{}, fmt.Errorf("invalid bgp peer %q, expected <as>@<address>[:port]", s)
+	}
+	as, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || as == 0 {
+		return BGPPeer{}, fmt.Errorf("invalid as number of bgp peer %q", s)
+	}
+	addr := parts[1]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, bgpPort)
+	}
+
+	return BGPPeer{Address: addr, AS: uint32(as)}, nil
+}
+
+// bgpSpeaker is a minimal bgp speaker announcing ipv4 unicast host prefixes to its
+// peers, it never learns routes from them
+type bgpSpeaker struct {
+	config   BGPConfig
+	mu       sync.Mutex
+	prefixes map[string]*net.IPNet
+	peers    []*bgpPeer
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type bgpPeer struct {
+	BGPPeer
+	speaker *bgpSpeaker
+	mu      sync.Mutex
+	conn    net.Conn // established session, nil while down
+	as4     bool     // the peer supports 4-octet as numbers
+}
+
+// bgpOpen is a decoded open message
+type bgpOpen struct {
+	AS       uint32
+	HoldTime time.Duration
+	RouterID net.IP
+	AS4      bool
+}
+
+// newBGPSpeaker starts the sessions with the configured peers
+func newBGPSpeaker(config *BGPConfig) (*bgpSpeaker, error) {
+	c := *config
+	if c.LocalAS == 0 {
+		return nil, fmt.Errorf("bgp speaker requires a local as")
+	}
+	if c.RouterID.To4() == nil {
+		return nil, fmt.Errorf("bgp router id %v is not an ipv4 address", c.RouterID)
+	}
+	if c.NextHop == nil {
+		c.NextHop = c.RouterID
+	}
+	if c.NextHop.To4() == nil {
+		return nil, fmt.Errorf("bgp next hop %v is not an ipv4 address", c.NextHop)
+	}
+	s := &bgpSpeaker{
+		config:   c,
+		prefixes: map[string]*net.IPNet{},
+		done:     make(chan struct{}),
+	}
+	for _, p := range c.Peers {
+		peer := &bgpPeer{BGPPeer: p, speaker: s}
+		s.peers = append(s.peers, peer)
+		s.wg.Add(1)
+		go peer.run()
+	}
+
+	return s, nil
+}
+
+// Announce advertises the prefix to the established peers and to those established later
+func (s *bgpSpeaker) Announce(prefix *net.IPNet) error {
+	if prefix.IP.To4() == nil {
+		return types.NotImplementedErrorf("bgp speaker only announces ipv4 prefixes, %s is not announced", prefix)
+	}
+	s.mu.Lock()
+	s.prefixes[prefix.String()] = prefix
+	s.mu.Unlock()
+	for _, p := range s.peers {
+		p.update([]*net.IPNet{prefix}, nil)
+	}
+
+	return nil
+}
+
+// Withdraw withdraws the prefix from the established peers
+func (s *bgpSpeaker) Withdraw(prefix *net.IPNet) error {
+	if prefix.IP.To4() == nil {
+		return nil
+	}
+	s.mu.Lock()
+	delete(s.prefixes, prefix.String())
+	s.mu.Unlock()
+	for _, p := range s.peers {
+		p.update(nil, []*net.IPNet{prefix})
+	}
+
+	return nil
+}
+
+// Close tears down the sessions, the peers then withdraw the announced prefixes
+func (s *bgpSpeaker) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	return nil
+}
+
+func (s *bgpSpeaker) announced() []*net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefixes := make([]*net.IPNet, 0, len(s.prefixes))
+	for _, p := range s.prefixes {
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+// openBody encodes an open message advertising ipv4 unicast and 4-octet as support
+func (s *bgpSpeaker) openBody(hold time.Duration) []byte {
+	caps := []byte{
+		bgpCapMultiprotocol, 4, 0, 1, 0, 1, // afi ipv4, safi unicast
+		bgpCapAS4, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(caps[8:], s.config.LocalAS)
+
+	var b bytes.Buffer
+	b.WriteByte(bgpVersion)
+	binary.Write(&b, binary.BigEndian, twoOctetAS(s.config.LocalAS))
+	binary.Write(&b, binary.BigEndian, uint16(hold/time.Second))
+	b.Write(s.config.RouterID.To4())
+	b.WriteByte(byte(2 + len(caps)))
+	b.WriteByte(bgpOptParamCapability)
+	b.WriteByte(byte(len(caps)))
+	b.Write(caps)
+
+	return b.Bytes()
+}
+
+// updateBody encodes an update message, internal peers get an empty as path
+func (s *bgpSpeaker) updateBody(peerAS uint32, as4 bool, announced, withdrawn []*net.IPNet) []byte {
+	var attrs bytes.Buffer
+	if len(announced) > 0 {
+		attrs.Write([]byte{bgpAttrFlagTransitive, bgpAttrOrigin, 1, bgpOriginIGP})
+		switch {
+		case peerAS == s.config.LocalAS:
+			attrs.Write([]byte{bgpAttrFlagTransitive, bgpAttrASPath, 0})
+		case as4:
+			attrs.Write([]byte{bgpAttrFlagTransitive, bgpAttrASPath, 6, bgpASSequence, 1})
+			binary.Write(&attrs, binary.BigEndian, s.config.LocalAS)
+		default:
+			attrs.Write([]byte{bgpAttrFlagTransitive, bgpAttrASPath, 4, bgpASSequence, 1})
+			binary.Write(&attrs, binary.BigEndian, twoOctetAS(s.config.LocalAS))
+		}
+		attrs.Write([]byte{bgpAttrFlagTransitive, bgpAttrNextHop, 4})
+		attrs.Write(s.config.NextHop.To4())
+		if peerAS == s.config.LocalAS {
+			attrs.Write([]byte{bgpAttrFlagTransitive, bgpAttrLocalPref, 4})
+			binary.Write(&attrs, binary.BigEndian, uint32(bgpLocalPref))
+		}
+	}
+	wd := encodePrefixes(withdrawn)
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(len(wd)))
+	b.Write(wd)
+	binary.Write(&b, binary.BigEndian, uint16(attrs.Len()))
+	b.Write(attrs.Bytes())
+	b.Write(encodePrefixes(announced))
+
+	return b.Bytes()
+}
+
+// twoOctetAS returns the as number carried in 2-octet fields
+func twoOctetAS(as uint32) uint16 {
+	if as > 0xffff {
+		return bgpASTrans
+	}
+	return uint16(as)
+}
+
+// encodePrefixes encodes ipv4 prefixes in the nlri format
+func encodePrefixes(prefixes []*net.IPNet) []byte {
+	var b []byte
+	for _, p := range prefixes {
+		ones, _ := p.Mask.Size()
+		b = append(b, byte(ones))
+		b = append(b, p.IP.To4()[:(ones+7)/8]...)
+	}
+	return b
+}
+
+// parseBGPOpen decodes an open message and its capabilities
+func parseBGPOpen(body []byte) (*bgpOpen, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("bgp open message too short")
+	}
+	if body[0] != bgpVersion {
+		return nil, fmt.Errorf("unsupported bgp version %d", body[0])
+	}
+	o := &bgpOpen{
+		AS:       uint32(binary.BigEndian.Uint16(body[1:])),
+		HoldTime: time.Duration(binary.BigEndian.Uint16(body[3:])) * time.Second,
+		RouterID: net.IP(body[5:9]),
+	}
+	if o.HoldTime > 0 && o.HoldTime < 3*time.Second {
+		return nil, fmt.Errorf("invalid bgp hold time %s", o.HoldTime)
+	}
+	params := body[10:]
+	if int(body[9]) != len(params) {
+		return nil, fmt.Errorf("invalid bgp optional parameters length %d", body[9])
+	}
+	for len(params) >= 2 {
+		ptype, plen := params[0], int(params[1])
+		if len(params) < 2+plen {
+			return nil, fmt.Errorf("truncated bgp optional parameter")
+		}
+		caps := params[2 : 2+plen]
+		for ptype == bgpOptParamCapability && len(caps) >= 2 {
+			code, clen := caps[0], int(caps[1])
+			if len(caps) < 2+clen {
+				return nil, fmt.Errorf("truncated bgp capability")
+			}
+			if code == bgpCapAS4 && clen == 4 {
+				o.AS4 = true
+				o.AS = binary.BigEndian.Uint32(caps[2:])
+			}
+			caps = caps[2+clen:]
+		}
+		params = params[2+plen:]
+	}
+
+	return o, nil
+}
+
+// writeBGPMessage writes a message with the bgp header
+func writeBGPMessage(w io.Writer, msgType byte, body []byte) error {
+	msg := make([]byte, bgpHeaderLen, bgpHeaderLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(bgpHeaderLen+len(body)))
+	msg[18] = msgType
+	_, err := w.Write(append(msg, body...))
+
+	return err
+}
+
+// readBGPMessage reads a message and returns its type and body
+func readBGPMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, bgpHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < bgpHeaderLen || length > bgpMaxMessageLen {
+		return 0, nil, fmt.Errorf("invalid bgp message length %d", length)
+	}
+	body := make([]byte, length-bgpHeaderLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header[18], body, nil
+}
+
+// notificationError describes a notification message sent by the peer
+func notificationError(body []byte) error {
+	if len(body) < 2 {
+		return fmt.Errorf("bgp peer sent a notification")
+	}
+	return fmt.Errorf("bgp peer sent a notification with error code %d subcode %d", body[0], body[1])
+}
+
+// run keeps the session with the peer established until the speaker is closed
+func (p *bgpPeer) run() {
+	defer p.speaker.wg.Done()
+	for {
+		err := p.session()
+		select {
+		case <-p.speaker.done:
+			return
+		default:
+		}
+		logrus.Warnf("bgp session with peer %s is down, retrying in %s: %v", p.Address, bgpRetryInterval, err)
+		select {
+		case <-p.speaker.done:
+			return
+		case <-time.After(bgpRetryInterval):
+		}
+	}
+}
+
+// dial connects to the peer from the host network namespace
+func (p *bgpPeer) dial() (net.Conn, error) {
+	defer osl.InitOSContext()()
+	return net.DialTimeout("tcp", p.Address, bgpConnectTimeout)
+}
+
+// session establishes a session, announces the prefixes and serves it until it fails
+func (p *bgpPeer) session() error {
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		// unblock the session reads on shutdown
+		select {
+		case <-p.speaker.done:
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	if err := writeBGPMessage(conn, bgpMsgOpen, p.speaker.openBody(bgpHoldTime)); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(bgpHoldTime))
+	msgType, body, err := readBGPMessage(conn)
+	if err != nil {
+		return err
+	}
+	if msgType == bgpMsgNotification {
+		return notificationError(body)
+	}
+	if msgType != bgpMsgOpen {
+		return fmt.Errorf("expected a bgp open message, received type %d", msgType)
+	}
+	open, err := parseBGPOpen(body)
+	if err != nil {
+		return err
+	}
+	if open.AS != p.AS {
+		return fmt.Errorf("bgp peer as %d does not match the configured as %d", open.AS, p.AS)
+	}
+	hold := bgpHoldTime
+	if open.HoldTime < hold {
+		hold = open.HoldTime
+	}
+	if err := writeBGPMessage(conn, bgpMsgKeepalive, nil); err != nil {
+		return err
+	}
+	if msgType, body, err = readBGPMessage(conn); err != nil {
+		return err
+	}
+	if msgType == bgpMsgNotification {
+		return notificationError(body)
+	}
+	if msgType != bgpMsgKeepalive {
+		return fmt.Errorf("expected a bgp keepalive message, received type %d", msgType)
+	}
+
+	if err := p.establish(conn, open.AS4); err != nil {
+		return err
+	}
+	defer p.teardown(conn)
+	logrus.Infof("bgp session with peer %s established", p.Address)
+	if hold > 0 {
+		go p.keepalive(conn, hold/3, stopped)
+	}
+	for {
+		// keepalives of the peer reset the hold timer, its updates are ignored
+		deadline := time.Time{}
+		if hold > 0 {
+			deadline = time.Now().Add(hold)
+		}
+		conn.SetReadDeadline(deadline)
+		msgType, body, err := readBGPMessage(conn)
+		if err != nil {
+			return err
+		}
+		if msgType == bgpMsgNotification {
+			return notificationError(body)
+		}
+	}
+}
+
+// establish binds the session to the peer and announces the current prefixes
+func (p *bgpPeer) establish(conn net.Conn, as4 bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn, p.as4 = conn, as4
+	prefixes := p.speaker.announced()
+	for len(prefixes) > 0 {
+		n := len(prefixes)
+		if n > bgpMaxPrefixes {
+			n = bgpMaxPrefixes
+		}
+		if err := p.write(bgpMsgUpdate, p.speaker.updateBody(p.AS, p.as4, prefixes[:n], nil)); err != nil {
+			p.conn = nil
+			return err
+		}
+		prefixes = prefixes[n:]
+	}
+
+	return nil
+}
+
+func (p *bgpPeer) teardown(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+}
+
+// update sends an update when the session is established, a failed write tears the
+// session down and the prefixes are announced again once it is reestablished
+func (p *bgpPeer) update(announced, withdrawn []*net.IPNet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return
+	}
+	if err := p.write(bgpMsgUpdate, p.speaker.updateBody(p.AS, p.as4, announced, withdrawn)); err != nil {
+		logrus.Warnf("Failed to send a bgp update to peer %s: %v", p.Address, err)
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+func (p *bgpPeer) keepalive(conn net.Conn, interval time.Duration, stopped chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-t.C:
+		}
+		p.mu.Lock()
+		if p.conn == conn {
+			if err := p.write(bgpMsgKeepalive, nil); err != nil {
+				conn.Close()
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// write sends a message on the established session, p.mu is held
+func (p *bgpPeer) write(msgType byte, body []byte) error {
+	p.conn.SetWriteDeadline(time.Now().Add(bgpConnectTimeout))
+	return writeBGPMessage(p.conn, msgType, body)
+}
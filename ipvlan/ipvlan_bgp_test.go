@@ -0,0 +1,182 @@
+package ipvlan
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/testutils"
+)
+
+// decodePrefixes decodes ipv4 prefixes in the nlri format
+func decodePrefixes(b []byte) ([]string, error) {
+	var prefixes []string
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if ones > 32 || len(b) < 1+n {
+			return nil, fmt.Errorf("invalid nlri %v", b)
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, b[1:1+n])
+		prefixes = append(prefixes, (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}).String())
+		b = b[1+n:]
+	}
+	return prefixes, nil
+}
+
+// describeUpdate renders an update as +prefix via next-hop path as or -prefix
+func describeUpdate(body []byte) ([]string, error) {
+	wlen := int(binary.BigEndian.Uint16(body))
+	withdrawn, err := decodePrefixes(body[2 : 2+wlen])
+	if err != nil {
+		return nil, err
+	}
+	rest := body[2+wlen:]
+	alen := int(binary.BigEndian.Uint16(rest))
+	attrs, nlri := rest[2:2+alen], rest[2+alen:]
+	var nextHop net.IP
+	var path []uint32
+	for len(attrs) > 0 {
+		flags, code, hdr, l := attrs[0], attrs[1], 3, int(attrs[2])
+		if flags&bgpAttrFlagExtended != 0 {
+			hdr, l = 4, int(binary.BigEndian.Uint16(attrs[2:]))
+		}
+		value := attrs[hdr : hdr+l]
+		switch code {
+		case bgpAttrNextHop:
+			nextHop = net.IP(value)
+		case bgpAttrASPath:
+			for i := 2; i+4 <= len(value); i += 4 {
+				path = append(path, binary.BigEndian.Uint32(value[i:]))
+			}
+		}
+		attrs = attrs[hdr+l:]
+	}
+	announced, err := decodePrefixes(nlri)
+	if err != nil {
+		return nil, err
+	}
+	var events []string
+	for _, p := range withdrawn {
+		events = append(events, "-"+p)
+	}
+	for _, p := range announced {
+		events = append(events, fmt.Sprintf("+%s via %s path %v", p, nextHop, path))
+	}
+	return events, nil
+}
+
+// serveTestBGPPeer accepts a session on l as AS 65000 and reports the received updates
+func serveTestBGPPeer(l net.Listener, events chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		events <- err.Error()
+		return
+	}
+	defer conn.Close()
+	local := &bgpSpeaker{config: BGPConfig{LocalAS: 65000, RouterID: net.ParseIP("10.0.0.254")}}
+	msgType, body, err := readBGPMessage(conn)
+	if err != nil || msgType != bgpMsgOpen {
+		events <- fmt.Sprintf("expected an open message: %v", err)
+		return
+	}
+	if open, err := parseBGPOpen(body); err != nil || open.AS != 65001 || !open.AS4 {
+		events <- fmt.Sprintf("unexpected open message %v: %v", open, err)
+		return
+	}
+	writeBGPMessage(conn, bgpMsgOpen, local.openBody(3*time.Second))
+	writeBGPMessage(conn, bgpMsgKeepalive, nil)
+	for {
+		msgType, body, err := readBGPMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msgType {
+		case bgpMsgKeepalive:
+			writeBGPMessage(conn, bgpMsgKeepalive, nil)
+		case bgpMsgUpdate:
+			updates, err := describeUpdate(body)
+			if err != nil {
+				events <- err.Error()
+				return
+			}
+			for _, u := range updates {
+				events <- u
+			}
+		}
+	}
+}
+
+func expectEvent(t *testing.T, events <-chan string, expected string) {
+	select {
+	case e := <-events:
+		if e != expected {
+			t.Fatalf("expected %q from the bgp peer, got %q", expected, e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %q from the bgp peer", expected)
+	}
+}
+
+// TestL3Routes tests dual-stack l3 endpoints get host routes and their ipv4 prefix is
+// announced to a bgp peer
+func TestL3Routes(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	events := make(chan string, 16)
+	go serveTestBGPPeer(l, events)
+
+	d, err := NewDriver(map[string]interface{}{
+		BGPOption: &BGPConfig{
+			LocalAS:  65001,
+			RouterID: net.ParseIP("10.0.0.1"),
+			Peers:    []BGPPeer{{Address: l.Addr().String(), AS: 65000}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	req := newTestNetworkRequest(t, testNetworkID, "192.168.60.0/24", map[string]interface{}{driverModeOpt: modeL3})
+	req.IPv6Data = newTestNetworkRequest(t, testNetworkID, "2001:db8:60::/64", nil).IPv4Data
+	if err := d.CreateNetwork(req); err != nil {
+		t.Fatalf("failed to create a dual-stack network: %v", err)
+	}
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.60.2/24", AddressIPv6: "2001:db8:60::2/64"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	parent, err := ns.NlHandle().LinkByName(d.network(testNetworkID).config.Parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.168.60.2", "2001:db8:60::2"} {
+		if !hasHostRoute(t, parent, ip) {
+			t.Fatalf("no host route to the l3 endpoint address %s through the parent", ip)
+		}
+	}
+	// only the ipv4 prefix is announced, an ipv6 update would precede the withdrawal below
+	expectEvent(t, events, "+192.168.60.2/32 via 10.0.0.1 path [65001]")
+
+	if err := d.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+		t.Fatalf("failed to delete endpoint: %v", err)
+	}
+	if hasHostRoute(t, parent, "192.168.60.2") {
+		t.Fatal("host route to the deleted endpoint was not removed")
+	}
+	expectEvent(t, events, "-192.168.60.2/32")
+}
@@ -0,0 +1,417 @@
+package ipvlan
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/d2g/dhcp4"
+	"github.com/d2g/dhcp4client"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/osl"
+	"github.com/docker/libnetwork/types"
+)
+
+const (
+	dhcpOpt           = "dhcp" // lease endpoint addresses over dhcp -o dhcp=true
+	ipvlanLeasePrefix = ipvlanPrefix + "/lease"
+	dhcpTimeout       = 10 * time.Second
+	dhcpRetryInterval = 30 * time.Second
+	dhcpDefaultLease  = time.Hour // used when the server omits the lease time
+)
+
+// dhcpLease is the dhcp lease acquired on behalf of an endpoint. Every ipvlan slave
+// shares the mac address of the parent, leases are told apart by their client-id
+type dhcpLease struct {
+	ID       string // endpoint id
+	Nid      string
+	Parent   string
+	ClientID []byte
+	Ack      []byte // last acknowledgement of the server
+	Renew    time.Time
+	Expiry   time.Time
+	dbIndex  uint64
+	dbExists bool
+	stop     chan struct{}
+	err      error // why an expired lease could not be rebound
+}
+
+// newLease returns the lease of the endpoint, the client-id is derived from the endpoint id
+// or from the reservation of the endpoint so that servers hand the same address back
+func newLease(ep *endpoint, parent string) *dhcpLease {
+	clientID := ep.id
+	if ep.reservation != "" {
+		clientID = reservationKey(ep.nid, ep.reservation)
+	}
+	return &dhcpLease{
+		ID:       ep.id,
+		Nid:      ep.nid,
+		Parent:   parent,
+		ClientID: append([]byte{0}, clientID...),
+	}
+}
+
+// newDhcpClient opens a dhcp client on a packet socket bound to the parent link
+func newDhcpClient(parent string) (*dhcp4client.Client, error) {
+	link, err := ns.NlHandle().LinkByName(parent)
+	if err != nil {
+		return nil, types.NotFoundErrorf("failed to find the parent link %s: %v", parent, err)
+	}
+	pkt, err := dhcp4client.NewPacketSock(link.Attrs().Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a dhcp socket on %s: %v", parent, err)
+	}
+	c, err := dhcp4client.New(
+		dhcp4client.HardwareAddr(link.Attrs().HardwareAddr),
+		dhcp4client.Timeout(dhcpTimeout),
+		// the slaves share the parent mac, the server can not unicast the reply
+		dhcp4client.Broadcast(true),
+		dhcp4client.Connection(pkt),
+	)
+	if err != nil {
+		pkt.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// withClientID tags a client packet with the client-id of the lease
+func (l *dhcpLease) withClientID(p dhcp4.Packet) dhcp4.Packet {
+	p.AddOption(dhcp4.OptionClientIdentifier, l.ClientID)
+	p.PadToMinSize()
+	return p
+}
+
+// acquire runs the discover, offer, request and acknowledge exchange
+func (l *dhcpLease) acquire() error {
+	c, err := newDhcpClient(l.Parent)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	discover := l.withClientID(c.DiscoverPacket())
+	offer, err := c.GetOffer(&discover)
+	if err != nil {
+		return fmt.Errorf("no dhcp offer received on %s: %v", l.Parent, err)
+	}
+	request := l.withClientID(c.RequestPacket(&offer))
+	ack, err := c.GetAcknowledgement(&request)
+	if err != nil {
+		return fmt.Errorf("no dhcp acknowledgement received on %s: %v", l.Parent, err)
+	}
+
+	return l.bind(ack)
+}
+
+// renew extends the lease with the server that granted it
+func (l *dhcpLease) renew() error {
+	c, err := newDhcpClient(l.Parent)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	prev := dhcp4.Packet(l.Ack)
+	request := l.withClientID(c.RenewalRequestPacket(&prev))
+	ack, err := c.GetAcknowledgement(&request)
+	if err != nil {
+		return fmt.Errorf("no dhcp acknowledgement received on %s: %v", l.Parent, err)
+	}
+
+	return l.bind(ack)
+}
+
+// rebind acquires the address of an expired lease again with a new discover. The endpoint
+// is configured with the leased address, any other address is refused
+func (l *dhcpLease) rebind() error {
+	prev := l.address()
+	if err := l.acquire(); err != nil {
+		return err
+	}
+	if addr := l.address(); !addr.IP.Equal(prev.IP) {
+		if err := l.release(); err != nil {
+			logrus.Debugf("Failed to release the dhcp lease of endpoint %s: %v", l.ID[0:7], err)
+		}
+		return fmt.Errorf("dhcp server offered %s instead of the expired %s", addr.IP, prev.IP)
+	}
+
+	return nil
+}
+
+// release hands the leased address back to the server
+func (l *dhcpLease) release() error {
+	c, err := newDhcpClient(l.Parent)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	prev := dhcp4.Packet(l.Ack)
+	return c.SendPacket(l.withClientID(c.ReleasePacket(&prev)))
+}
+
+// bind records an acknowledgement and schedules the next renewal
+func (l *dhcpLease) bind(ack dhcp4.Packet) error {
+	opts := ack.ParseOptions()
+	if t, ok := opts[dhcp4.OptionDHCPMessageType]; !ok || len(t) != 1 || dhcp4.MessageType(t[0]) != dhcp4.ACK {
+		return fmt.Errorf("dhcp server declined the lease of endpoint %s", l.ID)
+	}
+	lease := optionDuration(opts, dhcp4.OptionIPAddressLeaseTime, dhcpDefaultLease)
+	now := time.Now()
+	l.Ack = []byte(ack)
+	l.Renew = now.Add(optionDuration(opts, dhcp4.OptionRenewalTimeValue, lease/2))
+	l.Expiry = now.Add(lease)
+
+	return nil
+}
+
+// optionDuration decodes a dhcp time option in seconds
+func optionDuration(opts dhcp4.Options, code dhcp4.OptionCode, def time.Duration) time.Duration {
+	if v, ok := opts[code]; ok && len(v) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return def
+}
+
+// address returns the leased address with the mask of the leased subnet
+func (l *dhcpLease) address() *net.IPNet {
+	ack := dhcp4.Packet(l.Ack)
+	ip := ack.YIAddr().To4()
+	mask := ip.DefaultMask()
+	if v, ok := ack.ParseOptions()[dhcp4.OptionSubnetMask]; ok && len(v) == net.IPv4len {
+		mask = net.IPMask(v)
+	}
+	return &net.IPNet{IP: ip, Mask: mask}
+}
+
+// router returns the first router handed out with the lease
+func (l *dhcpLease) router() net.IP {
+	if v, ok := dhcp4.Packet(l.Ack).ParseOptions()[dhcp4.OptionRouter]; ok && len(v) >= net.IPv4len {
+		return net.IP(v[:net.IPv4len])
+	}
+	return nil
+}
+
+// acquireLease leases an address for the endpoint on the parent of the network
+func (d *driver) acquireLease(n *network, ep *endpoint) (*dhcpLease, error) {
+	l := newLease(ep, n.config.Parent)
+	if err := l.acquire(); err != nil {
+		return nil, err
+	}
+	if err := d.storeUpdate(l); err != nil {
+		if err := l.release(); err != nil {
+			logrus.Debugf("Failed to release the dhcp lease of endpoint %s: %v", ep.id[0:7], err)
+		}
+		return nil, fmt.Errorf("failed to save the dhcp lease of endpoint %s to store: %v", ep.id[0:7], err)
+	}
+	d.startLease(l)
+	logrus.Debugf("Leased %s for endpoint %s on %s until %s", l.address(), ep.id[0:7], l.Parent, l.Expiry)
+
+	return l, nil
+}
+
+// startLease tracks the lease and renews it in the background until it is released
+func (d *driver) startLease(l *dhcpLease) {
+	l.stop = make(chan struct{})
+	d.leaseMu.Lock()
+	d.leases[l.ID] = l
+	d.leaseMu.Unlock()
+	go d.maintainLease(l)
+}
+
+func (d *driver) maintainLease(l *dhcpLease) {
+	for {
+		d.leaseMu.Lock()
+		wait := l.Renew.Sub(time.Now())
+		d.leaseMu.Unlock()
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(wait):
+		}
+		err := d.updateLease(l, (*dhcpLease).renew)
+		if err == nil {
+			continue
+		}
+		d.leaseMu.Lock()
+		expired := time.Now().After(l.Expiry)
+		if !expired {
+			logrus.Warnf("Failed to renew the dhcp lease of endpoint %s, retrying: %v", l.ID[0:7], err)
+			l.Renew = time.Now().Add(dhcpRetryInterval)
+		}
+		d.leaseMu.Unlock()
+		if !expired {
+			continue
+		}
+		// the address is no longer held, bind it again from scratch
+		if err := d.updateLease(l, (*dhcpLease).rebind); err != nil {
+			d.leaseMu.Lock()
+			l.err = err
+			d.leaseMu.Unlock()
+			logrus.Errorf("dhcp lease of endpoint %s expired and could not be rebound, the endpoint keeps using an address it no longer holds: %v", l.ID[0:7], err)
+			return
+		}
+		logrus.Infof("Rebound the expired dhcp lease of endpoint %s", l.ID[0:7])
+	}
+}
+
+// updateLease runs the dhcp exchange fn on a copy of the lease and records the result, the
+// lease is not held locked during the exchange
+func (d *driver) updateLease(l *dhcpLease, fn func(*dhcpLease) error) error {
+	defer osl.InitOSContext()()
+
+	d.leaseMu.Lock()
+	next := *l
+	d.leaseMu.Unlock()
+	if err := fn(&next); err != nil {
+		return err
+	}
+	d.leaseMu.Lock()
+	defer d.leaseMu.Unlock()
+	select {
+	case <-l.stop:
+		// released during the exchange
+		return nil
+	default:
+	}
+	l.Ack, l.Renew, l.Expiry = next.Ack, next.Renew, next.Expiry
+	if err := d.storeUpdate(l); err != nil {
+		logrus.Warnf("Failed to save the dhcp lease of endpoint %s to store: %v", l.ID[0:7], err)
+	}
+
+	return nil
+}
+
+// leaseRouter returns the router handed out with the lease of the endpoint
+func (d *driver) leaseRouter(eid string) net.IP {
+	d.leaseMu.Lock()
+	defer d.leaseMu.Unlock()
+	if l, ok := d.leases[eid]; ok {
+		return l.router()
+	}
+	return nil
+}
+
+// leaseError returns why the expired lease of the endpoint could not be rebound
+func (d *driver) leaseError(eid string) error {
+	d.leaseMu.Lock()
+	defer d.leaseMu.Unlock()
+	if l, ok := d.leases[eid]; ok {
+		return l.err
+	}
+	return nil
+}
+
+// releaseLease stops the renewal of the endpoint lease and releases it
+func (d *driver) releaseLease(eid string) {
+	d.leaseMu.Lock()
+	l, ok := d.leases[eid]
+	if ok {
+		delete(d.leases, eid)
+		close(l.stop)
+	}
+	d.leaseMu.Unlock()
+	if !ok {
+		return
+	}
+	if err := l.release(); err != nil {
+		logrus.Warnf("Failed to release the dhcp lease of endpoint %s: %v", eid[0:7], err)
+	}
+	if err := d.storeDelete(l); err != nil {
+		logrus.Warnf("Failed to remove the dhcp lease of endpoint %s from store: %v", eid[0:7], err)
+	}
+}
+
+// populateLeases resumes the renewal of the persisted leases, leases of endpoints
+// that no longer exist are released
+func (d *driver) populateLeases() error {
+	kvol, err := d.store.List(datastore.Key(ipvlanLeasePrefix), &dhcpLease{})
+	if err != nil && err != datastore.ErrKeyNotFound {
+		storeErrors.WithLabelValues("list").Inc()
+		return fmt.Errorf("failed to get ipvlan dhcp leases from store: %v", err)
+	}
+	if err == datastore.ErrKeyNotFound {
+		return nil
+	}
+	for _, kvo := range kvol {
+		l := kvo.(*dhcpLease)
+		if d.unrestored[l.Nid] {
+			continue
+		}
+		n, ok := d.networks[l.Nid]
+		if !ok || n.endpoints[l.ID] == nil {
+			logrus.Debugf("Releasing the stale dhcp lease of endpoint (%s)", l.ID[0:7])
+			if err := l.release(); err != nil {
+				logrus.Debugf("Failed to release the stale dhcp lease of endpoint (%s): %v", l.ID[0:7], err)
+			}
+			if err := d.storeDelete(l); err != nil {
+				logrus.Debugf("Failed to delete the stale dhcp lease of endpoint (%s) from store: %v", l.ID[0:7], err)
+			}
+			continue
+		}
+		// an expired lease is renewed right away
+		d.startLease(l)
+		logrus.Debugf("dhcp lease of endpoint (%s) restored", l.ID[0:7])
+	}
+
+	return nil
+}
+
+func (l *dhcpLease) Key() []string {
+	return []string{ipvlanLeasePrefix, l.ID}
+}
+
+func (l *dhcpLease) KeyPrefix() []string {
+	return []string{ipvlanLeasePrefix}
+}
+
+func (l *dhcpLease) Value() []byte {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (l *dhcpLease) SetValue(value []byte) error {
+	return json.Unmarshal(value, l)
+}
+
+func (l *dhcpLease) Index() uint64 {
+	return l.dbIndex
+}
+
+func (l *dhcpLease) SetIndex(index uint64) {
+	l.dbIndex = index
+	l.dbExists = true
+}
+
+func (l *dhcpLease) Exists() bool {
+	return l.dbExists
+}
+
+func (l *dhcpLease) Skip() bool {
+	return false
+}
+
+func (l *dhcpLease) New() datastore.KVObject {
+	return &dhcpLease{}
+}
+
+func (l *dhcpLease) CopyTo(o datastore.KVObject) error {
+	dst := o.(*dhcpLease)
+	*dst = *l
+	dst.ClientID = append([]byte(nil), l.ClientID...)
+	dst.Ack = append([]byte(nil), l.Ack...)
+	return nil
+}
+
+func (l *dhcpLease) DataScope() string {
+	return datastore.LocalScope
+}
@@ -0,0 +1,236 @@
+package ipvlan
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/testutils"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/vishvananda/netlink"
+)
+
+const testEndpointID2 = "4f5e6d7c8b9a0f1e2d3c4b5a69788796a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0"
+
+// testDhcpServer leases addresses by client-id and counts the renewals, renewals are
+// refused when nak is set
+type testDhcpServer struct {
+	sync.Mutex
+	ip       net.IP
+	options  dhcp.Options
+	leases   map[string]net.IP
+	next     int
+	renewals int
+	nak      bool
+}
+
+func (s *testDhcpServer) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
+	s.Lock()
+	defer s.Unlock()
+	id := string(options[dhcp.OptionClientIdentifier])
+	switch msgType {
+	case dhcp.Discover:
+		ip, ok := s.leases[id]
+		if !ok {
+			s.next++
+			ip = dhcp.IPAdd(s.ip, s.next)
+			s.leases[id] = ip
+		}
+		return dhcp.ReplyPacket(p, dhcp.Offer, s.ip, ip, 4*time.Second, s.options.SelectOrderOrAll(nil))
+	case dhcp.Request:
+		ip, ok := s.leases[id]
+		if !ok {
+			return dhcp.ReplyPacket(p, dhcp.NAK, s.ip, nil, 0, nil)
+		}
+		if !p.CIAddr().Equal(net.IPv4zero) {
+			if s.nak {
+				return dhcp.ReplyPacket(p, dhcp.NAK, s.ip, nil, 0, nil)
+			}
+			s.renewals++
+		}
+		return dhcp.ReplyPacket(p, dhcp.ACK, s.ip, ip, 4*time.Second, s.options.SelectOrderOrAll(nil))
+	case dhcp.Release:
+		delete(s.leases, id)
+	}
+
+	return nil
+}
+
+func (s *testDhcpServer) counts() (int, int) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.leases), s.renewals
+}
+
+// startTestDhcpServer serves dhcp on one end of a veth pair and returns the other end
+func startTestDhcpServer(t *testing.T) (*testDhcpServer, string) {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "dhcp-parent"}, PeerName: "dhcp-server"}
+	if err := ns.NlHandle().LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	server, err := ns.NlHandle().LinkByName("dhcp-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := netlink.ParseAddr("10.30.0.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.NlHandle().AddrAdd(server, addr); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []netlink.Link{veth, server} {
+		if err := ns.NlHandle().LinkSetUp(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := net.ListenPacket("udp4", ":67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testDhcpServer{
+		ip:     addr.IP.To4(),
+		leases: map[string]net.IP{},
+		options: dhcp.Options{
+			dhcp.OptionSubnetMask: []byte(addr.Mask),
+			dhcp.OptionRouter:     []byte(addr.IP.To4()),
+		},
+	}
+	go dhcp.ServeIf(server.Attrs().Index, conn, s)
+
+	return s, veth.Name
+}
+
+// waitFor polls the condition until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestDhcpLeases tests endpoints sharing the parent mac lease distinct addresses which are
+// renewed in the background and released when the endpoints are deleted
+func TestDhcpLeases(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	server, parent := startTestDhcpServer(t)
+	d, err := NewDriver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := map[string]interface{}{parentOpt: parent, dhcpOpt: "true"}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "0.0.0.0/0", options)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+
+	var addrs []string
+	for _, eid := range []string{testEndpointID, testEndpointID2} {
+		res, err := d.CreateEndpoint(&api.CreateEndpointRequest{
+			NetworkID:  testNetworkID,
+			EndpointID: eid,
+			Interface:  &api.EndpointInterface{},
+		})
+		if err != nil {
+			t.Fatalf("failed to create endpoint: %v", err)
+		}
+		if res.Interface == nil {
+			t.Fatal("expected the leased address in the create endpoint response")
+		}
+		addrs = append(addrs, res.Interface.Address)
+	}
+	if addrs[0] != "10.30.0.2/24" || addrs[1] != "10.30.0.3/24" {
+		t.Fatalf("expected distinct leases per client-id, got %v", addrs)
+	}
+
+	res, err := d.Join(&api.JoinRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	if res.Gateway != "10.30.0.1" {
+		t.Fatalf("expected the router of the lease as gateway, got %q", res.Gateway)
+	}
+
+	// the leases are renewed at half of their 4s lease time
+	waitFor(t, 10*time.Second, "both leases to be renewed", func() bool {
+		_, renewals := server.counts()
+		return renewals >= 2
+	})
+
+	for _, eid := range []string{testEndpointID, testEndpointID2} {
+		if err := d.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: eid}); err != nil {
+			t.Fatalf("failed to delete endpoint: %v", err)
+		}
+	}
+	// the release is not acknowledged by the server
+	waitFor(t, 5*time.Second, "the leases to be released", func() bool {
+		leases, _ := server.counts()
+		return leases == 0
+	})
+}
+
+// TestDhcpLeaseRebind tests an expired lease is rebound with a new discover, and a lease
+// whose address is not handed back is reported instead of retried
+func TestDhcpLeaseRebind(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	server, parent := startTestDhcpServer(t)
+	d, err := NewDriver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := map[string]interface{}{parentOpt: parent, dhcpOpt: "true"}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "0.0.0.0/0", options)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	for _, eid := range []string{testEndpointID, testEndpointID2} {
+		_, err := d.CreateEndpoint(&api.CreateEndpointRequest{
+			NetworkID:  testNetworkID,
+			EndpointID: eid,
+			Interface:  &api.EndpointInterface{},
+		})
+		if err != nil {
+			t.Fatalf("failed to create endpoint: %v", err)
+		}
+	}
+
+	// renewals are refused, the second endpoint's address is given away by the server
+	server.Lock()
+	server.nak = true
+	delete(server.leases, string(d.leases[testEndpointID2].ClientID))
+	server.Unlock()
+	d.leaseMu.Lock()
+	for _, l := range d.leases {
+		l.Expiry = time.Now()
+	}
+	rebound, lost := d.leases[testEndpointID], d.leases[testEndpointID2]
+	d.leaseMu.Unlock()
+
+	// the renewals are due at half of the 4s lease time
+	waitFor(t, 10*time.Second, "the expired leases to be rebound or lost", func() bool {
+		d.leaseMu.Lock()
+		defer d.leaseMu.Unlock()
+		return rebound.Expiry.After(time.Now()) && lost.err != nil
+	})
+	d.leaseMu.Lock()
+	if rebound.err != nil || !rebound.Expiry.After(time.Now()) {
+		t.Fatalf("expected the expired lease to be rebound, got expiry %s: %v", rebound.Expiry, rebound.err)
+	}
+	if lost.err == nil {
+		t.Fatal("expected the lease of a given away address to fail")
+	}
+	d.leaseMu.Unlock()
+	res, err := d.EndpointOperInfo(&api.EndpointInfoRequest{NetworkID: testNetworkID, EndpointID: testEndpointID2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Value["DHCPLeaseError"]; !ok {
+		t.Fatalf("expected the lease failure in the endpoint info, got %v", res.Value)
+	}
+}
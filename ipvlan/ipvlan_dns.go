@@ -0,0 +1,86 @@
+package ipvlan
+
+import (
+	"net"
+	"strings"
+
+	"github.com/docker/libnetwork/types"
+)
+
+// The resolver settings of a network are persisted with its configuration and reported by
+// EndpointOperInfo. The remote driver api carries no dns fields in the join response, docker
+// keeps configuring the container resolv.conf from its own --dns flags.
+const (
+	dnsOpt        = "dns"         // resolvers of the endpoints -o dns=<ip>,...
+	dnsSearchOpt  = "dns_search"  // search domains of the endpoints -o dns_search=<domain>,...
+	dnsOptionsOpt = "dns_options" // resolver options of the endpoints -o dns_options=ndots:2,...
+	maxDNSServers = 3             // resolvers honoured by the resolv.conf of the containers
+	maxDomainLen  = 253
+)
+
+// splitList splits a comma separated option value, empty entries are ignored
+func splitList(value string) []string {
+	var list []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// parseDNSServers parses the comma separated addresses of the resolvers
+func parseDNSServers(value string) ([]string, error) {
+	var servers []string
+	for _, s := range splitList(value) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, types.BadRequestErrorf("invalid dns server %q", s)
+		}
+		servers = append(servers, ip.String())
+	}
+	if len(servers) > maxDNSServers {
+		return nil, types.BadRequestErrorf("at most %d dns servers are supported, got %d", maxDNSServers, len(servers))
+	}
+
+	return servers, nil
+}
+
+// parseDNSSearch parses the comma separated search domains
+func parseDNSSearch(value string) ([]string, error) {
+	var domains []string
+	for _, d := range splitList(value) {
+		name := strings.TrimSuffix(d, ".")
+		if name == "" || len(name) > maxDomainLen || strings.ContainsAny(name, " \t") || strings.Contains(name, "..") {
+			return nil, types.BadRequestErrorf("invalid dns search domain %q", d)
+		}
+		domains = append(domains, name)
+	}
+
+	return domains, nil
+}
+
+// parseDNSOptions parses the comma separated resolver options, e.g. ndots:2
+func parseDNSOptions(value string) ([]string, error) {
+	var options []string
+	for _, o := range splitList(value) {
+		if strings.ContainsAny(o, " \t") {
+			return nil, types.BadRequestErrorf("invalid dns option %q", o)
+		}
+		options = append(options, o)
+	}
+
+	return options, nil
+}
+
+// stringList converts a list decoded from json to strings
+func stringList(v interface{}) []string {
+	items, _ := v.([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -1,15 +1,12 @@
 package ipvlan
 
 import (
-	"fmt"
-
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/ns"
 	"github.com/docker/libnetwork/osl"
 	"github.com/docker/libnetwork/types"
 	"github.com/docker/libnetwork/drivers/remote/api"
-	"net"
 )
 
 // CreateEndpoint assigns the mac, ip and endpoint id for the new container
@@ -21,32 +18,40 @@ func (d *driver) CreateEndpoint(r *api.CreateEndpointRequest) (*api.CreateEndpoi
 	}
 	n, err := d.getNetwork(r.NetworkID)
 	if err != nil {
-		return nil, fmt.Errorf("network id %q not found", r.NetworkID)
+		return nil, types.NotFoundErrorf("network id %q not found", r.NetworkID)
+	}
+	if err := d.ensureParent(n); err != nil {
+		return nil, err
 	}
 
 	if len(r.Interface.MacAddress) != 0 {
-		return nil, fmt.Errorf("%s interfaces do not support custom mac address assigment", ipvlanType)
+		return nil, macAddressError(n.config)
+	}
+	name, err := reservationName(r.Options)
+	if err != nil {
+		return nil, err
 	}
 
 	ep := &endpoint{
-		id:     r.EndpointID,
-		nid:    r.NetworkID,
+		id:          r.EndpointID,
+		nid:         r.NetworkID,
+		reservation: name,
 	}
 
-	if len(r.Interface.Address) == 0 {
-		return nil, fmt.Errorf("create endpoint was not passed an IP address")
+	if len(r.Interface.Address) == 0 && len(r.Interface.AddressIPv6) == 0 && !n.config.Dhcp {
+		return nil, types.BadRequestErrorf("create endpoint was not passed an IP address")
 	}
 	if len(r.Interface.Address) > 0 {
-		_, addressIPv4, err := net.ParseCIDR(r.Interface.Address)
+		addressIPv4, err := types.ParseCIDR(r.Interface.Address)
 		if err != nil {
-			return nil, fmt.Errorf("%s is an invalid ipv4 address", r.Interface.Address)
+			return nil, types.BadRequestErrorf("%s is an invalid ipv4 address", r.Interface.Address)
 		}
 		ep.addr = addressIPv4
 	}
 	if len(r.Interface.AddressIPv6) > 0 {
-		_, addressIPv6, err := net.ParseCIDR(r.Interface.AddressIPv6)
+		addressIPv6, err := types.ParseCIDR(r.Interface.AddressIPv6)
 		if err != nil {
-			return nil, fmt.Errorf("%s %d is an invalid ipv6 address", r.Interface.AddressIPv6, len(r.Interface.AddressIPv6))
+			return nil, types.BadRequestErrorf("%s %d is an invalid ipv6 address", r.Interface.AddressIPv6, len(r.Interface.AddressIPv6))
 		}
 		ep.addrv6 = addressIPv6
 	}
@@ -68,13 +73,44 @@ func (d *driver) CreateEndpoint(r *api.CreateEndpointRequest) (*api.CreateEndpoi
 		}
 	}
 
+	resp := &api.CreateEndpointResponse{}
+	// without an address from docker ipam the v4 address is leased over dhcp
+	if ep.addr == nil && n.config.Dhcp {
+		lease, err := d.acquireLease(n, ep)
+		if err != nil {
+			// a missing parent link is not fixed by retrying, unlike an unanswered request
+			switch err.(type) {
+			case types.NotFoundError:
+				return nil, types.NotFoundErrorf("failed to lease an address for endpoint %s: %v", ep.id[0:7], err)
+			case types.BadRequestError:
+				return nil, types.BadRequestErrorf("failed to lease an address for endpoint %s: %v", ep.id[0:7], err)
+			}
+			return nil, types.NoServiceErrorf("failed to lease an address for endpoint %s: %v", ep.id[0:7], err)
+		}
+		ep.addr = lease.address()
+		resp.Interface = &api.EndpointInterface{Address: ep.addr.String()}
+	}
+	if ep.reservation != "" {
+		if err := d.claimReservation(n, ep); err != nil {
+			d.releaseLease(ep.id)
+			return nil, err
+		}
+	}
+
+	if err := n.addEndpointRoutes(ep); err != nil {
+		d.unclaimReservation(ep)
+		d.releaseLease(ep.id)
+		return nil, err
+	}
 	if err := d.storeUpdate(ep); err != nil {
-		return nil, fmt.Errorf("failed to save ipvlan endpoint %s to store: %v", ep.id[0:7], err)
+		n.delEndpointRoutes(ep)
+		d.unclaimReservation(ep)
+		d.releaseLease(ep.id)
+		return nil, types.InternalErrorf("failed to save ipvlan endpoint %s to store: %v", ep.id[0:7], err)
 	}
 
 	n.addEndpoint(ep)
 
-	resp := &api.CreateEndpointResponse{}
 	return resp, nil
 }
 
@@ -86,19 +122,96 @@ func (d *driver) DeleteEndpoint(r *api.DeleteEndpointRequest) error {
 	}
 	n := d.network(r.NetworkID)
 	if n == nil {
-		return fmt.Errorf("network id %q not found", r.NetworkID)
+		return types.NotFoundErrorf("network id %q not found", r.NetworkID)
 	}
 	ep := n.endpoint(r.EndpointID)
 	if ep == nil {
-		return fmt.Errorf("endpoint id %q not found", r.EndpointID)
+		return types.NotFoundErrorf("endpoint id %q not found", r.EndpointID)
 	}
 	if link, err := ns.NlHandle().LinkByName(ep.srcName); err == nil {
 		ns.NlHandle().LinkDel(link)
 	}
+	d.forgetEndpoint(n, ep)
+	return nil
+}
+
+// forgetEndpoint releases the routes, lease and reservation of the endpoint and removes
+// it from the network and the store, leaving its slave link alone
+func (d *driver) forgetEndpoint(n *network, ep *endpoint) {
+	n.delEndpointRoutes(ep)
+	d.releaseLease(ep.id)
+	d.unclaimReservation(ep)
 
 	if err := d.storeDelete(ep); err != nil {
 		logrus.Warnf("Failed to remove ipvlan endpoint %s from store: %v", ep.id[0:7], err)
 	}
 	n.deleteEndpoint(ep.id)
-	return nil
+}
+
+// EndpointOperInfo returns the operational details of the endpoint and its slave link
+func (d *driver) EndpointOperInfo(r *api.EndpointInfoRequest) (*api.EndpointInfoResponse, error) {
+	if err := validateID(r.NetworkID, r.EndpointID); err != nil {
+		return nil, err
+	}
+	n, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	ep := n.endpoint(r.EndpointID)
+	if ep == nil {
+		return nil, types.NotFoundErrorf("endpoint id %q not found", r.EndpointID)
+	}
+	mtu := n.config.Mtu
+	if mtu == 0 {
+		// the slave inherits the mtu of the parent link
+		if link, err := ns.NlHandle().LinkByName(n.config.Parent); err == nil {
+			mtu = link.Attrs().MTU
+		}
+	}
+	value := map[string]interface{}{
+		"SrcName":    ep.srcName,
+		"IfIndex":    ep.ifIndex,
+		"Parent":     n.config.Parent,
+		"IpvlanMode": n.config.IpvlanMode,
+		"IpvlanFlag": n.config.IpvlanFlag,
+		"Mtu":        mtu,
+	}
+	if ep.addr != nil {
+		value["IPv4Address"] = ep.addr.String()
+	}
+	if ep.addrv6 != nil {
+		value["IPv6Address"] = ep.addrv6.String()
+	}
+	if ep.reservation != "" {
+		value["Reservation"] = ep.reservation
+	}
+	if err := d.leaseError(ep.id); err != nil {
+		value["DHCPLeaseError"] = err.Error()
+	}
+	// report the same gateways and routes the endpoint is handed on join
+	jinfo := &api.JoinResponse{}
+	if err := n.setJoinInfo(ep, jinfo); err != nil {
+		logrus.Debugf("could not resolve the join info of endpoint %s: %v", r.EndpointID, err)
+	}
+	if jinfo.Gateway != "" {
+		value["Gateway"] = jinfo.Gateway
+	}
+	if jinfo.GatewayIPv6 != "" {
+		value["GatewayIPv6"] = jinfo.GatewayIPv6
+	}
+	if len(jinfo.StaticRoutes) > 0 {
+		value["StaticRoutes"] = jinfo.StaticRoutes
+	}
+	// the join response has no dns fields, the resolver settings are only reported here
+	if len(n.config.DNS) > 0 {
+		value["DNSServers"] = n.config.DNS
+	}
+	if len(n.config.DNSSearch) > 0 {
+		value["DNSSearch"] = n.config.DNSSearch
+	}
+	if len(n.config.DNSOptions) > 0 {
+		value["DNSOptions"] = n.config.DNSOptions
+	}
+
+	return &api.EndpointInfoResponse{Value: value}, nil
 }
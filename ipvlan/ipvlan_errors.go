@@ -0,0 +1,69 @@
+package ipvlan
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/docker/libnetwork/types"
+)
+
+// The driver methods classify their errors with the libnetwork types error classes and
+// ConflictError. The handler answers each class with its own http status:
+//
+//	types.BadRequestError      400 invalid options, addresses or identifiers
+//	types.ForbiddenError       403 requests refused in the current state, e.g. a held reservation
+//	types.NotFoundError        404 unknown networks, endpoints and parent interfaces
+//	ConflictError              409 networks conflicting with existing networks
+//	types.NotImplementedError  501 features missing from the kernel or the driver configuration
+//	types.NoServiceError,
+//	types.RetryError,
+//	types.TimeoutError         503 transient failures, the request can be retried
+//	anything else              500
+const (
+	errClassBadRequest     = "bad_request"
+	errClassForbidden      = "forbidden"
+	errClassNotFound       = "not_found"
+	errClassConflict       = "conflict"
+	errClassNotImplemented = "not_implemented"
+	errClassRetry          = "retry"
+	errClassInternal       = "internal"
+)
+
+// ConflictError is an interface for errors of requests conflicting with the existing
+// networks, e.g. a network created twice or overlapping subnets on a shared parent
+type ConflictError interface {
+	// Conflict makes implementer into ConflictError type
+	Conflict()
+}
+
+type conflictError string
+
+func (c conflictError) Error() string {
+	return string(c)
+}
+
+func (c conflictError) Conflict() {}
+
+// conflictErrorf creates an instance of ConflictError
+func conflictErrorf(format string, params ...interface{}) error {
+	return conflictError(fmt.Sprintf(format, params...))
+}
+
+// errorStatus returns the http status and the class name of a driver error
+func errorStatus(err error) (int, string) {
+	switch err.(type) {
+	case types.BadRequestError:
+		return http.StatusBadRequest, errClassBadRequest
+	case types.ForbiddenError:
+		return http.StatusForbidden, errClassForbidden
+	case types.NotFoundError:
+		return http.StatusNotFound, errClassNotFound
+	case ConflictError:
+		return http.StatusConflict, errClassConflict
+	case types.NotImplementedError:
+		return http.StatusNotImplemented, errClassNotImplemented
+	case types.NoServiceError, types.RetryError, types.TimeoutError:
+		return http.StatusServiceUnavailable, errClassRetry
+	}
+	return http.StatusInternalServerError, errClassInternal
+}
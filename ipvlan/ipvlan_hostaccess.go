@@ -0,0 +1,84 @@
+package ipvlan
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/driverapi"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	hostAccessOpt = "host_access" // host to container access -o host_access=true, also the aux address name
+	shimPrefix    = "ih-"         // ipvlan prefix for the host access shim link
+)
+
+// getShimName returns the name of the host access shim with truncated net ID and driver prefix
+func getShimName(netID string) string {
+	return fmt.Sprintf("%s%s", shimPrefix, netID)
+}
+
+// hostAccessAddress returns the address reserved for the host access shim with
+// --aux-address host_access=<ip>, docker ipam never hands it to a container
+func hostAccessAddress(ipamV4Data []driverapi.IPAMData) (string, error) {
+	for _, ipd := range ipamV4Data {
+		if addr, ok := ipd.AuxAddresses[hostAccessOpt]; ok && addr != nil {
+			return addr.IP.String(), nil
+		}
+	}
+
+	return "", types.BadRequestErrorf("-o %s requires an ipv4 address reserved with --aux-address %s=<ip>", hostAccessOpt, hostAccessOpt)
+}
+
+// createHostShim creates the ipvlan slave giving the host access to the containers of
+// the network, a slave can reach its sibling slaves but never its own parent
+func (config *configuration) createHostShim() error {
+	name := getShimName(stringid.TruncateID(config.ID))
+	link, _ := ns.NlHandle().LinkByName(name)
+	if link != nil && !isIPVlanSlave(link, config.Parent) {
+		// a shim left behind on a former parent
+		if err := ns.NlHandle().LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete the stale host access link %s: %v", name, err)
+		}
+		link = nil
+	}
+	if link == nil {
+		if _, err := createIPVlan(name, config.Parent, config.IpvlanMode, config.IpvlanFlag, config.Mtu); err != nil {
+			return err
+		}
+		var err error
+		if link, err = ns.NlHandle().LinkByName(name); err != nil {
+			return fmt.Errorf("failed to find the host access link %s: %v", name, err)
+		}
+	}
+	// a host address keeps the subnet routed through the parent links of the host
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(config.HostAddress), Mask: net.CIDRMask(32, 32)}}
+	if err := ns.NlHandle().AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("failed to set address %s on the host access link %s: %v", config.HostAddress, name, err)
+	}
+	if err := ns.NlHandle().LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to enable the host access link %s: %v", name, err)
+	}
+	logrus.Debugf("Host access link %s with address %s created on %s", name, config.HostAddress, config.Parent)
+
+	return nil
+}
+
+// delHostShim deletes the host access shim and with it the routes to the containers
+func (config *configuration) delHostShim() error {
+	name := getShimName(stringid.TruncateID(config.ID))
+	link, err := ns.NlHandle().LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	if err := ns.NlHandle().LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete the host access link %s: %v", name, err)
+	}
+	logrus.Debugf("Deleted the host access link: %s", name)
+
+	return nil
+}
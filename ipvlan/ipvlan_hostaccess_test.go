@@ -0,0 +1,110 @@
+package ipvlan
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/testutils"
+	"github.com/docker/libnetwork/types"
+	"github.com/vishvananda/netlink"
+)
+
+// hasHostRoute checks the host routes ip through the link
+func hasHostRoute(t *testing.T, link netlink.Link, ip string) bool {
+	routes, err := ns.NlHandle().RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range routes {
+		if r.Dst != nil && r.Dst.IP.Equal(net.ParseIP(ip)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TestHostAccess tests the host access link is rebuilt on restart, routes the endpoint
+// addresses and is deleted with the network
+func TestHostAccess(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	dir, err := ioutil.TempDir("", "ipvlan-hostaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newTestDriver(t, dir)
+	req := newTestNetworkRequest(t, testNetworkID, "192.168.50.0/24", map[string]interface{}{hostAccessOpt: "true"})
+	if err := d.CreateNetwork(req); err == nil {
+		t.Fatal("expected an error creating a host access network without a reserved address")
+	}
+	aux, err := types.ParseCIDR("192.168.50.254/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.IPv4Data[0].AuxAddresses = map[string]*net.IPNet{hostAccessOpt: aux}
+	if err := d.CreateNetwork(req); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	shimName := getShimName(stringid.TruncateID(testNetworkID))
+	shim, err := ns.NlHandle().LinkByName(shimName)
+	if err != nil {
+		t.Fatalf("host access link %s was not created: %v", shimName, err)
+	}
+	if !isIPVlanSlave(shim, d.network(testNetworkID).config.Parent) {
+		t.Fatalf("host access link %s is not a slave of the network parent", shimName)
+	}
+	addrs, err := ns.NlHandle().AddrList(shim, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].IPNet.String() != "192.168.50.254/32" {
+		t.Fatalf("unexpected host access addresses: %v", addrs)
+	}
+
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.50.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	if !hasHostRoute(t, shim, "192.168.50.2") {
+		t.Fatal("no host route to the endpoint through the host access link")
+	}
+
+	// a restarted driver rebuilds the link and its routes from the store
+	d.Close()
+	if err := ns.NlHandle().LinkDel(shim); err != nil {
+		t.Fatal(err)
+	}
+	d = newTestDriver(t, dir)
+	defer d.Close()
+	if shim, err = ns.NlHandle().LinkByName(shimName); err != nil {
+		t.Fatalf("host access link %s was not rebuilt: %v", shimName, err)
+	}
+	if !hasHostRoute(t, shim, "192.168.50.2") {
+		t.Fatal("host route to the endpoint was not restored")
+	}
+
+	if err := d.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+		t.Fatalf("failed to delete endpoint: %v", err)
+	}
+	if hasHostRoute(t, shim, "192.168.50.2") {
+		t.Fatal("host route to the deleted endpoint was not removed")
+	}
+	if err := d.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: testNetworkID}); err != nil {
+		t.Fatalf("failed to delete network: %v", err)
+	}
+	if parentExists(shimName) {
+		t.Fatalf("host access link %s was not deleted with the network", shimName)
+	}
+}
@@ -0,0 +1,134 @@
+package ipvlan
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	internalTable        = 4094 // routing table shared by internal networks, only holds unreachable defaults
+	internalRulePriority = 4094 // priority of the rules confining internal networks to their subnets
+)
+
+// internalOption reads the --internal label docker passes with the network options
+func internalOption(options map[string]interface{}) bool {
+	if v, ok := options[netlabel.Internal]; ok {
+		if internal, ok := v.(bool); ok {
+			return internal
+		}
+	}
+	return false
+}
+
+// internalRules returns the policy rules of an internal network. The traffic of a subnet to
+// the subnet is looked up in the main table, any other destination is unreachable
+func (config *configuration) internalRules() ([]*netlink.Rule, error) {
+	var rules []*netlink.Rule
+	for _, s := range config.subnets() {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		family := netlink.FAMILY_V4
+		if subnet.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		local := netlink.NewRule()
+		local.Family = family
+		local.Priority = internalRulePriority
+		local.Src = subnet
+		local.Dst = subnet
+		local.Table = syscall.RT_TABLE_MAIN
+		confined := netlink.NewRule()
+		confined.Family = family
+		confined.Priority = internalRulePriority + 1
+		confined.Src = subnet
+		confined.Table = internalTable
+		rules = append(rules, local, confined)
+	}
+
+	return rules, nil
+}
+
+// addInternalRules keeps the l3 and l3s endpoints of an internal network off the routes
+// of the host. The endpoints have no default route but they are routed by the host stack
+func (config *configuration) addInternalRules() error {
+	if !config.Internal || !config.routed() {
+		return nil
+	}
+	// the unreachable default of a family is only installed for networks with subnets of
+	// the family, hosts with ipv6 disabled refuse the ipv6 one
+	var defaults []string
+	if len(config.Ipv4Subnets) > 0 {
+		defaults = append(defaults, "0.0.0.0/0")
+	}
+	if len(config.Ipv6Subnets) > 0 {
+		defaults = append(defaults, "::/0")
+	}
+	for _, dst := range defaults {
+		_, def, _ := net.ParseCIDR(dst)
+		route := &netlink.Route{Dst: def, Table: internalTable, Type: syscall.RTN_UNREACHABLE}
+		if err := ns.NlHandle().RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add the unreachable %s route of the internal networks: %v", dst, err)
+		}
+	}
+	rules, err := config.internalRules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		// older kernels accept duplicate rules, the network is recreated on every restart
+		exists, err := ruleExists(rule)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := ns.NlHandle().RuleAdd(rule); err != nil {
+			return fmt.Errorf("failed to add the rule confining internal network %s to %s: %v", config.ID, rule.Src, err)
+		}
+	}
+
+	return nil
+}
+
+// ruleExists checks if a rule with the same priority, selectors and table is installed
+func ruleExists(rule *netlink.Rule) (bool, error) {
+	rules, err := ns.NlHandle().RuleList(rule.Family)
+	if err != nil {
+		return false, fmt.Errorf("failed to list the policy rules: %v", err)
+	}
+	for _, r := range rules {
+		if r.Priority == rule.Priority && r.Table == rule.Table &&
+			types.CompareIPNet(r.Src, rule.Src) && types.CompareIPNet(r.Dst, rule.Dst) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// delInternalRules deletes the rules of an internal network, the unreachable routes are kept
+func (config *configuration) delInternalRules() {
+	if !config.Internal || !config.routed() {
+		return
+	}
+	rules, err := config.internalRules()
+	if err != nil {
+		logrus.Debugf("Failed to resolve the rules of internal network %s: %v", config.ID, err)
+		return
+	}
+	for _, rule := range rules {
+		if err := ns.NlHandle().RuleDel(rule); err != nil {
+			logrus.Debugf("Failed to delete the rule of internal network %s on %s: %v", config.ID, rule.Src, err)
+		}
+	}
+}
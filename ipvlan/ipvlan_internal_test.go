@@ -0,0 +1,101 @@
+package ipvlan
+
+import (
+	"testing"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+// countInternalRules returns the number of rules confining the internal networks
+func countInternalRules(t *testing.T) int {
+	rules, err := ns.NlHandle().RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, r := range rules {
+		if r.Priority == internalRulePriority || r.Priority == internalRulePriority+1 {
+			count++
+		}
+	}
+
+	return count
+}
+
+// TestInternalNetwork tests an internal l3 network with a real parent hands out no
+// default route and is confined to its subnet by policy rules
+func TestInternalNetwork(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	master := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dm-internal"}}
+	if err := ns.NlHandle().LinkAdd(master); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.NlHandle().LinkSetUp(master); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDriver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := "dm-internal.20"
+	req := newTestNetworkRequest(t, testNetworkID, "192.168.70.0/24", map[string]interface{}{parentOpt: parent, driverModeOpt: modeL3})
+	req.Options[netlabel.Internal] = true
+	if err := d.CreateNetwork(req); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	// the parent of an internal network is still the requested vlan link
+	link, err := ns.NlHandle().LinkByName(parent)
+	if err != nil {
+		t.Fatalf("parent %s was not created: %v", parent, err)
+	}
+	if link.Type() != "vlan" {
+		t.Fatalf("expected a vlan parent link, got %s", link.Type())
+	}
+	if c := countInternalRules(t); c != 2 {
+		t.Fatalf("expected 2 rules confining the internal network, found %d", c)
+	}
+	// a v4 only network installs no ipv6 unreachable default
+	for family, expected := range map[int]int{netlink.FAMILY_V4: 1, netlink.FAMILY_V6: 0} {
+		routes, err := ns.NlHandle().RouteListFiltered(family, &netlink.Route{Table: internalTable}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(routes) != expected {
+			t.Fatalf("expected %d unreachable routes of family %d, found %v", expected, family, routes)
+		}
+	}
+
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.70.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	res, err := d.Join(&api.JoinRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	if res.Gateway != "" || len(res.StaticRoutes) != 0 {
+		t.Fatalf("expected no gateway nor routes on an internal network, got %q %v", res.Gateway, res.StaticRoutes)
+	}
+
+	if err := d.Leave(&api.LeaveRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+		t.Fatalf("failed to leave: %v", err)
+	}
+	if err := d.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+		t.Fatalf("failed to delete endpoint: %v", err)
+	}
+	if err := d.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: testNetworkID}); err != nil {
+		t.Fatalf("failed to delete network: %v", err)
+	}
+	if c := countInternalRules(t); c != 0 {
+		t.Fatalf("expected the rules to be deleted with the network, found %d", c)
+	}
+}
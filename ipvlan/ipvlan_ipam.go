@@ -0,0 +1,523 @@
+package ipvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/datastore"
+	ipamapi "github.com/docker/libnetwork/ipams/remote/api"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/types"
+)
+
+const (
+	ipamPoolPrefix     = ipvlanPrefix + "/ipam"
+	localAddressSpace  = "IpvlanLocal"  // default address space of a local scope driver
+	globalAddressSpace = "IpvlanGlobal" // default address space of a global scope driver
+	excludeOpt         = "exclude"      // addresses never handed out --ipam-opt exclude=ip,cidr,ip-ip
+	ipRangeOpt         = "ip_range"     // allocatable sub range --ipam-opt ip_range=cidr
+	maxPoolAddresses   = 1 << 16        // addresses tracked per pool allocation bitmap
+	requestAddressType = "RequestAddressType"
+)
+
+// ipamPool is the persistent allocation state of an address pool
+type ipamPool struct {
+	ID       string
+	Pool     string
+	Range    string
+	Gateway  string
+	Exclude  []string
+	Bitmap   []byte
+	Refs     int // networks holding the pool, pools stored before counting have one
+	dbIndex  uint64
+	dbExists bool
+	scope    string
+}
+
+// poolLayout is the parsed address layout of an ipamPool
+type poolLayout struct {
+	pool      *net.IPNet
+	v6        bool
+	start     *big.Int
+	size      uint64
+	network   *big.Int
+	broadcast *big.Int
+	exclude   [][2]*big.Int
+}
+
+// GetIpamCapabilities returns the ipam driver capabilities
+func (d *driver) GetIpamCapabilities() (*ipamapi.GetCapabilityResponse, error) {
+	return &ipamapi.GetCapabilityResponse{RequiresMACAddress: false}, nil
+}
+
+// GetDefaultAddressSpaces returns the default address spaces of the ipam driver
+func (d *driver) GetDefaultAddressSpaces() (*ipamapi.GetAddressSpacesResponse, error) {
+	return &ipamapi.GetAddressSpacesResponse{
+		LocalDefaultAddressSpace:  localAddressSpace,
+		GlobalDefaultAddressSpace: globalAddressSpace,
+	}, nil
+}
+
+// RequestPool reserves the pool from --subnet or -o subnet=, with the optional gateway,
+// ip_range and exclude options, and persists its allocation bitmap in the driver store
+func (d *driver) RequestPool(r *ipamapi.RequestPoolRequest) (*ipamapi.RequestPoolResponse, error) {
+	pool := r.Pool
+	if pool == "" {
+		pool = r.Options[subnetOpt]
+	}
+	if pool == "" {
+		return nil, types.BadRequestErrorf("%s ipam requires a subnet, pass --subnet or --ipam-opt %s=", ipvlanType, subnetOpt)
+	}
+	_, nw, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, types.BadRequestErrorf("invalid pool %s: %v", pool, err)
+	}
+	if (nw.IP.To4() == nil) != r.V6 {
+		return nil, types.BadRequestErrorf("pool %s does not match the requested address family", pool)
+	}
+	ipRange := r.SubPool
+	if ipRange == "" {
+		ipRange = r.Options[ipRangeOpt]
+	}
+	if ipRange == "" {
+		ipRange = nw.String()
+	}
+	p := &ipamPool{
+		ID:      r.AddressSpace + "/" + nw.String(),
+		Pool:    nw.String(),
+		Range:   ipRange,
+		Gateway: r.Options[gatewayOpt],
+		scope:   d.ipamScope(),
+	}
+	if v, ok := r.Options[excludeOpt]; ok && v != "" {
+		p.Exclude = strings.Split(v, ",")
+	}
+	if ipRange != nw.String() {
+		p.ID = p.ID + "/" + ipRange
+	}
+
+	d.ipamMu.Lock()
+	defer d.ipamMu.Unlock()
+	// networks on the same subnet, e.g. on different parents, share the pool as it was
+	// reserved, it is released with the last of them
+	var existing *ipamPool
+	err = d.updatePoolLocked(p.ID, func(e *ipamPool, l *poolLayout) error {
+		if err := e.checkOptions(p); err != nil {
+			return err
+		}
+		e.Refs = e.refs() + 1
+		existing = e
+		return nil
+	})
+	if err == nil {
+		return existing.response()
+	}
+	if _, ok := err.(types.NotFoundError); !ok {
+		return nil, err
+	}
+	p.Refs = 1
+	l, err := p.layout()
+	if err != nil {
+		return nil, err
+	}
+	p.Bitmap = make([]byte, (l.size+7)/8)
+	if p.Gateway != "" {
+		gw := net.ParseIP(p.Gateway)
+		if gw == nil || !l.pool.Contains(gw) {
+			return nil, types.BadRequestErrorf("gateway %s is not an address of pool %s", p.Gateway, p.Pool)
+		}
+		if off, ok := l.offset(gw); ok {
+			p.set(off)
+		}
+	}
+	if err := d.storeUpdate(p); err != nil {
+		return nil, err
+	}
+	if d.storeFor(p) == nil {
+		d.pools[p.ID] = p
+	}
+	logrus.Debugf("Requested ipam pool %s with range %s and exclusions %v", p.Pool, p.Range, p.Exclude)
+
+	return p.response()
+}
+
+// ReleasePool drops a reference to the pool, the last release forgets the pool and its
+// allocations
+func (d *driver) ReleasePool(r *ipamapi.ReleasePoolRequest) error {
+	d.ipamMu.Lock()
+	defer d.ipamMu.Unlock()
+	p, err := d.getPool(r.PoolID)
+	if err != nil {
+		return err
+	}
+	if p.refs() > 1 {
+		return d.updatePoolLocked(p.ID, func(p *ipamPool, l *poolLayout) error {
+			p.Refs = p.refs() - 1
+			return nil
+		})
+	}
+	delete(d.pools, p.ID)
+
+	return d.storeDelete(p)
+}
+
+// RequestAddress allocates the requested or the first free address of the pool
+func (d *driver) RequestAddress(r *ipamapi.RequestAddressRequest) (*ipamapi.RequestAddressResponse, error) {
+	var addr *net.IPNet
+	err := d.updatePool(r.PoolID, func(p *ipamPool, l *poolLayout) error {
+		var ip net.IP
+		switch {
+		case r.Address != "":
+			ip = net.ParseIP(r.Address)
+			if ip == nil || !l.pool.Contains(ip) {
+				return types.BadRequestErrorf("address %s is not part of pool %s", r.Address, p.Pool)
+			}
+			off, ok := l.offset(ip)
+			switch {
+			case !ok && r.Options[requestAddressType] != netlabel.Gateway:
+				// only the gateway is tracked outside of the allocation bitmap
+				return types.BadRequestErrorf("address %s is outside the %d allocatable addresses of pool %s starting at %s",
+					r.Address, l.size, p.Pool, l.ip(0))
+			case !ok:
+			case l.reserved(off):
+				return types.BadRequestErrorf("address %s of pool %s is reserved or excluded", r.Address, p.Pool)
+			case p.isSet(off):
+				return types.ForbiddenErrorf("address %s is already allocated", r.Address)
+			default:
+				p.set(off)
+			}
+		case r.Options[requestAddressType] == netlabel.Gateway && p.Gateway != "":
+			ip = net.ParseIP(p.Gateway)
+		default:
+			off, ok := p.firstFree(l, d.pinnedAddresses(p.Pool))
+			if !ok {
+				return types.NoServiceErrorf("no available addresses in pool %s", p.Pool)
+			}
+			p.set(off)
+			ip = l.ip(off)
+		}
+		if r.Options[requestAddressType] == netlabel.Gateway {
+			p.Gateway = ip.String()
+		}
+		addr = &net.IPNet{IP: ip, Mask: l.pool.Mask}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipamapi.RequestAddressResponse{Address: addr.String()}, nil
+}
+
+// ReleaseAddress returns the address to the pool
+func (d *driver) ReleaseAddress(r *ipamapi.ReleaseAddressRequest) error {
+	ip := net.ParseIP(r.Address)
+	if ip == nil {
+		return types.BadRequestErrorf("invalid address %s", r.Address)
+	}
+	return d.updatePool(r.PoolID, func(p *ipamPool, l *poolLayout) error {
+		if off, ok := l.offset(ip); ok {
+			p.unset(off)
+		}
+		if p.Gateway == ip.String() {
+			p.Gateway = ""
+		}
+		return nil
+	})
+}
+
+// ipamScope returns the scope of the store holding the ipam pools. A global store keeps
+// the addressing consistent across hosts
+func (d *driver) ipamScope() string {
+	if d.globalStore != nil {
+		return datastore.GlobalScope
+	}
+	return datastore.LocalScope
+}
+
+// getPool fetches the latest copy of the pool
+func (d *driver) getPool(id string) (*ipamPool, error) {
+	p := &ipamPool{ID: id, scope: d.ipamScope()}
+	ds := d.storeFor(p)
+	if ds == nil {
+		if cached, ok := d.pools[id]; ok {
+			return cached, nil
+		}
+		return nil, types.NotFoundErrorf("ipam pool %s not found", id)
+	}
+	if err := ds.GetObject(datastore.Key(p.Key()...), p); err != nil {
+		if err == datastore.ErrKeyNotFound {
+			return nil, types.NotFoundErrorf("ipam pool %s not found", id)
+		}
+		return nil, fmt.Errorf("failed to get ipam pool %s from store: %v", id, err)
+	}
+
+	return p, nil
+}
+
+// updatePool applies fn to the latest copy of the pool and persists it, retrying when
+// another host modified the pool in the global store meanwhile
+func (d *driver) updatePool(id string, fn func(p *ipamPool, l *poolLayout) error) error {
+	d.ipamMu.Lock()
+	defer d.ipamMu.Unlock()
+	return d.updatePoolLocked(id, fn)
+}
+
+// updatePoolLocked is updatePool for callers holding ipamMu
+func (d *driver) updatePoolLocked(id string, fn func(p *ipamPool, l *poolLayout) error) error {
+	for {
+		p, err := d.getPool(id)
+		if err != nil {
+			return err
+		}
+		l, err := p.layout()
+		if err != nil {
+			return err
+		}
+		if err := fn(p, l); err != nil {
+			return err
+		}
+		ds := d.storeFor(p)
+		if ds == nil {
+			d.pools[id] = p
+			return nil
+		}
+		err = ds.PutObjectAtomic(p)
+		if err == datastore.ErrKeyModified {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update ipam pool %s in store: %v", id, err)
+		}
+		return nil
+	}
+}
+
+// refs returns the number of networks holding the pool
+func (p *ipamPool) refs() int {
+	if p.Refs < 1 {
+		return 1
+	}
+	return p.Refs
+}
+
+// checkOptions returns a conflict error if the options of the requested pool differ from
+// the ones the shared pool was reserved with. A gateway allocated later by docker does not
+// conflict with a request without gateway
+func (p *ipamPool) checkOptions(r *ipamPool) error {
+	if r.Gateway != "" && !net.ParseIP(r.Gateway).Equal(net.ParseIP(p.Gateway)) {
+		return conflictErrorf("pool %s is already reserved with gateway %q, not %s", p.Pool, p.Gateway, r.Gateway)
+	}
+	if strings.Join(r.Exclude, ",") != strings.Join(p.Exclude, ",") {
+		return conflictErrorf("pool %s is already reserved with %s %q, not %q", p.Pool, excludeOpt,
+			strings.Join(p.Exclude, ","), strings.Join(r.Exclude, ","))
+	}
+	return nil
+}
+
+// response returns the pool reservation handed back to docker
+func (p *ipamPool) response() (*ipamapi.RequestPoolResponse, error) {
+	res := &ipamapi.RequestPoolResponse{PoolID: p.ID, Pool: p.Pool}
+	if p.Gateway != "" {
+		_, nw, err := net.ParseCIDR(p.Pool)
+		if err != nil {
+			return nil, err
+		}
+		gw := &net.IPNet{IP: net.ParseIP(p.Gateway), Mask: nw.Mask}
+		res.Data = map[string]string{netlabel.Gateway: gw.String()}
+	}
+
+	return res, nil
+}
+
+// layout parses the pool, its allocatable range and exclusions
+func (p *ipamPool) layout() (*poolLayout, error) {
+	_, nw, err := net.ParseCIDR(p.Pool)
+	if err != nil {
+		return nil, types.BadRequestErrorf("invalid pool %s: %v", p.Pool, err)
+	}
+	_, rng, err := net.ParseCIDR(p.Range)
+	if err != nil {
+		return nil, types.BadRequestErrorf("invalid %s %s: %v", ipRangeOpt, p.Range, err)
+	}
+	if !nw.Contains(rng.IP) {
+		return nil, types.BadRequestErrorf("%s %s is not part of pool %s", ipRangeOpt, p.Range, p.Pool)
+	}
+	l := &poolLayout{
+		pool:      nw,
+		v6:        nw.IP.To4() == nil,
+		start:     ipToInt(rng.IP),
+		network:   ipToInt(nw.IP),
+		broadcast: ipToInt(lastIP(nw)),
+		size:      maxPoolAddresses,
+	}
+	ones, bits := rng.Mask.Size()
+	if bits-ones < 16 {
+		l.size = 1 << uint(bits-ones)
+	}
+	for _, e := range p.Exclude {
+		from, to, err := parseExclusion(strings.TrimSpace(e))
+		if err != nil {
+			return nil, err
+		}
+		l.exclude = append(l.exclude, [2]*big.Int{ipToInt(from), ipToInt(to)})
+	}
+
+	return l, nil
+}
+
+// offset returns the bitmap offset of the address if it is part of the range
+func (l *poolLayout) offset(ip net.IP) (uint64, bool) {
+	off := new(big.Int).Sub(ipToInt(ip), l.start)
+	if off.Sign() < 0 || !off.IsUint64() || off.Uint64() >= l.size {
+		return 0, false
+	}
+	return off.Uint64(), true
+}
+
+// ip returns the address at the bitmap offset
+func (l *poolLayout) ip(off uint64) net.IP {
+	return intToIP(new(big.Int).Add(l.start, new(big.Int).SetUint64(off)), l.v6)
+}
+
+// reserved checks if the address at the offset can never be handed out
+func (l *poolLayout) reserved(off uint64) bool {
+	i := new(big.Int).Add(l.start, new(big.Int).SetUint64(off))
+	if i.Cmp(l.network) == 0 || (!l.v6 && i.Cmp(l.broadcast) == 0) {
+		return true
+	}
+	for _, e := range l.exclude {
+		if i.Cmp(e[0]) >= 0 && i.Cmp(e[1]) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// firstFree returns the first offset neither allocated, reserved nor pinned by an endpoint
+// reservation
+func (p *ipamPool) firstFree(l *poolLayout, pinned map[string]bool) (uint64, bool) {
+	for off := uint64(0); off < l.size; off++ {
+		if !p.isSet(off) && !l.reserved(off) && !pinned[l.ip(off).String()] {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+func (p *ipamPool) isSet(off uint64) bool {
+	return p.Bitmap[off/8]&(1<<(off%8)) != 0
+}
+
+func (p *ipamPool) set(off uint64) {
+	p.Bitmap[off/8] |= 1 << (off % 8)
+}
+
+func (p *ipamPool) unset(off uint64) {
+	p.Bitmap[off/8] &^= 1 << (off % 8)
+}
+
+// parseExclusion parses an excluded address, subnet or from-to address range
+func parseExclusion(e string) (net.IP, net.IP, error) {
+	if strings.Contains(e, "/") {
+		_, nw, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, nil, types.BadRequestErrorf("invalid %s subnet %s: %v", excludeOpt, e, err)
+		}
+		return nw.IP, lastIP(nw), nil
+	}
+	bounds := strings.SplitN(e, "-", 2)
+	from := net.ParseIP(strings.TrimSpace(bounds[0]))
+	to := from
+	if len(bounds) == 2 {
+		to = net.ParseIP(strings.TrimSpace(bounds[1]))
+	}
+	if from == nil || to == nil {
+		return nil, nil, types.BadRequestErrorf("invalid %s address or range %s", excludeOpt, e)
+	}
+	return from, to, nil
+}
+
+// lastIP returns the last address of the subnet
+func lastIP(nw *net.IPNet) net.IP {
+	ip := make(net.IP, len(nw.IP))
+	for i := range nw.IP {
+		ip[i] = nw.IP[i] | ^nw.Mask[i]
+	}
+	return ip
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+func intToIP(i *big.Int, v6 bool) net.IP {
+	n := net.IPv4len
+	if v6 {
+		n = net.IPv6len
+	}
+	b := i.Bytes()
+	ip := make(net.IP, n)
+	copy(ip[n-len(b):], b)
+	return ip
+}
+
+func (p *ipamPool) Key() []string {
+	return []string{ipamPoolPrefix, p.ID}
+}
+
+func (p *ipamPool) KeyPrefix() []string {
+	return []string{ipamPoolPrefix}
+}
+
+func (p *ipamPool) Value() []byte {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (p *ipamPool) SetValue(value []byte) error {
+	return json.Unmarshal(value, p)
+}
+
+func (p *ipamPool) Index() uint64 {
+	return p.dbIndex
+}
+
+func (p *ipamPool) SetIndex(index uint64) {
+	p.dbIndex = index
+	p.dbExists = true
+}
+
+func (p *ipamPool) Exists() bool {
+	return p.dbExists
+}
+
+func (p *ipamPool) Skip() bool {
+	return false
+}
+
+func (p *ipamPool) New() datastore.KVObject {
+	return &ipamPool{scope: p.scope}
+}
+
+func (p *ipamPool) CopyTo(o datastore.KVObject) error {
+	dstP := o.(*ipamPool)
+	*dstP = *p
+	dstP.Exclude = append([]string(nil), p.Exclude...)
+	dstP.Bitmap = append([]byte(nil), p.Bitmap...)
+	return nil
+}
+
+func (p *ipamPool) DataScope() string {
+	return p.scope
+}
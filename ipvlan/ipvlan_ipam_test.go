@@ -0,0 +1,173 @@
+package ipvlan
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	ipamapi "github.com/docker/libnetwork/ipams/remote/api"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/types"
+)
+
+func requestAddress(t *testing.T, d *driver, poolID string, options map[string]string) string {
+	res, err := d.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: poolID, Options: options})
+	if err != nil {
+		t.Fatalf("failed to request an address: %v", err)
+	}
+	return res.Address
+}
+
+// TestIpamAllocation tests gateway, exclusions and persistence of the pool allocations
+func TestIpamAllocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvlan-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newTestDriver(t, dir)
+	pool, err := d.RequestPool(&ipamapi.RequestPoolRequest{
+		AddressSpace: localAddressSpace,
+		Options: map[string]string{
+			subnetOpt:  "10.1.0.0/29",
+			gatewayOpt: "10.1.0.6",
+			excludeOpt: "10.1.0.2-10.1.0.3",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to request pool: %v", err)
+	}
+	if pool.Pool != "10.1.0.0/29" {
+		t.Fatalf("expected pool 10.1.0.0/29, got %s", pool.Pool)
+	}
+	if gw := pool.Data[netlabel.Gateway]; gw != "10.1.0.6/29" {
+		t.Fatalf("expected gateway 10.1.0.6/29, got %s", gw)
+	}
+	if gw := requestAddress(t, d, pool.PoolID, map[string]string{requestAddressType: netlabel.Gateway}); gw != "10.1.0.6/29" {
+		t.Fatalf("expected the configured gateway, got %s", gw)
+	}
+	if addr := requestAddress(t, d, pool.PoolID, nil); addr != "10.1.0.1/29" {
+		t.Fatalf("expected 10.1.0.1/29, got %s", addr)
+	}
+
+	// the allocations survive a driver restart
+	d = newTestDriver(t, dir)
+	if addr := requestAddress(t, d, pool.PoolID, nil); addr != "10.1.0.4/29" {
+		t.Fatalf("expected the excluded range to be skipped, got %s", addr)
+	}
+	if addr := requestAddress(t, d, pool.PoolID, nil); addr != "10.1.0.5/29" {
+		t.Fatalf("expected 10.1.0.5/29, got %s", addr)
+	}
+	// network, broadcast, gateway and exclusions are never handed out
+	if _, err := d.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: pool.PoolID}); err == nil {
+		t.Fatal("expected the pool to be exhausted")
+	}
+	if _, err := d.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: pool.PoolID, Address: "10.1.0.5"}); err == nil {
+		t.Fatal("expected an error requesting an allocated address")
+	}
+	// nor handed out when requested explicitly
+	for _, ip := range []string{"10.1.0.0", "10.1.0.7", "10.1.0.2"} {
+		_, err := d.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: pool.PoolID, Address: ip})
+		if _, ok := err.(types.BadRequestError); !ok {
+			t.Fatalf("expected a bad request error requesting reserved address %s, got %v", ip, err)
+		}
+	}
+
+	if err := d.ReleaseAddress(&ipamapi.ReleaseAddressRequest{PoolID: pool.PoolID, Address: "10.1.0.4"}); err != nil {
+		t.Fatal(err)
+	}
+	if addr := requestAddress(t, d, pool.PoolID, nil); addr != "10.1.0.4/29" {
+		t.Fatalf("expected the released address, got %s", addr)
+	}
+
+	if err := d.ReleasePool(&ipamapi.ReleasePoolRequest{PoolID: pool.PoolID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: pool.PoolID}); err == nil {
+		t.Fatal("expected an error requesting an address of a released pool")
+	}
+}
+
+// TestIpamRange tests explicit addresses outside the allocatable range are refused, except
+// for the gateway
+func TestIpamRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvlan-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newTestDriver(t, dir)
+	pool, err := d.RequestPool(&ipamapi.RequestPoolRequest{
+		AddressSpace: localAddressSpace,
+		Pool:         "10.3.0.0/24",
+		SubPool:      "10.3.0.0/28",
+	})
+	if err != nil {
+		t.Fatalf("failed to request pool: %v", err)
+	}
+	_, err = d.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: pool.PoolID, Address: "10.3.0.100"})
+	if _, ok := err.(types.BadRequestError); !ok {
+		t.Fatalf("expected a bad request error for an address outside the range, got %v", err)
+	}
+	res, err := d.RequestAddress(&ipamapi.RequestAddressRequest{
+		PoolID:  pool.PoolID,
+		Address: "10.3.0.254",
+		Options: map[string]string{requestAddressType: netlabel.Gateway},
+	})
+	if err != nil {
+		t.Fatalf("failed to request a gateway outside the range: %v", err)
+	}
+	if res.Address != "10.3.0.254/24" {
+		t.Fatalf("expected gateway 10.3.0.254/24, got %s", res.Address)
+	}
+}
+
+// TestIpamSharedPool tests a pool requested by two networks with the same options is kept
+// until both release it
+func TestIpamSharedPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvlan-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newTestDriver(t, dir)
+	req := &ipamapi.RequestPoolRequest{AddressSpace: localAddressSpace, Pool: "10.2.0.0/24"}
+	first, err := d.RequestPool(req)
+	if err != nil {
+		t.Fatalf("failed to request pool: %v", err)
+	}
+	second, err := d.RequestPool(req)
+	if err != nil {
+		t.Fatalf("failed to request pool: %v", err)
+	}
+	if first.PoolID != second.PoolID {
+		t.Fatalf("expected the same pool, got %s and %s", first.PoolID, second.PoolID)
+	}
+	// the pool can not be shared with different options
+	for _, options := range []map[string]string{{gatewayOpt: "10.2.0.254"}, {excludeOpt: "10.2.0.10"}} {
+		_, err := d.RequestPool(&ipamapi.RequestPoolRequest{AddressSpace: localAddressSpace, Pool: "10.2.0.0/24", Options: options})
+		if _, ok := err.(conflictError); !ok {
+			t.Fatalf("expected a conflict error sharing the pool with options %v, got %v", options, err)
+		}
+	}
+	if addr := requestAddress(t, d, first.PoolID, nil); addr != "10.2.0.1/24" {
+		t.Fatalf("expected 10.2.0.1/24, got %s", addr)
+	}
+
+	if err := d.ReleasePool(&ipamapi.ReleasePoolRequest{PoolID: first.PoolID}); err != nil {
+		t.Fatal(err)
+	}
+	// the other network still allocates from the pool
+	if addr := requestAddress(t, d, second.PoolID, nil); addr != "10.2.0.2/24" {
+		t.Fatalf("expected the allocations of the shared pool to be kept, got %s", addr)
+	}
+	if err := d.ReleasePool(&ipamapi.ReleasePoolRequest{PoolID: second.PoolID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: second.PoolID}); err == nil {
+		t.Fatal("expected an error requesting an address of a released pool")
+	}
+}
@@ -1,7 +1,6 @@
 package ipvlan
 
 import (
-	"fmt"
 	"net"
 
 	"github.com/Sirupsen/logrus"
@@ -28,29 +27,52 @@ var (
 // Join method is invoked when a Sandbox is attached to an endpoint.
 func (d *driver) Join(r *api.JoinRequest) (*api.JoinResponse, error) {
 	defer osl.InitOSContext()()
+	// the slave link is unbound until it is recorded as the endpoint srcName
+	d.linkMu.RLock()
+	defer d.linkMu.RUnlock()
 	n, err := d.getNetwork(r.NetworkID)
 	if err != nil {
 		return nil,err
 	}
 	endpoint := n.endpoint(r.EndpointID)
 	if endpoint == nil {
-		return nil, fmt.Errorf("could not find endpoint with id %s", r.EndpointID)
+		return nil, types.NotFoundErrorf("could not find endpoint with id %s", r.EndpointID)
 	}
-	// generate a name for the iface that will be renamed to eth0 in the sbox
-	containerIfName, err := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
-	if err != nil {
-		return nil, fmt.Errorf("error generating an interface name: %v", err)
+	// a retried join reuses the slave link left in the host namespace by the previous attempt
+	vethName := ""
+	if endpoint.srcName != "" {
+		if link, err := ns.NlHandle().LinkByName(endpoint.srcName); err == nil {
+			if isIPVlanSlave(link, n.config.Parent) {
+				vethName = endpoint.srcName
+				logrus.Debugf("Reusing ipvlan link %s for endpoint %s", vethName, r.EndpointID)
+			} else if link.Type() == ipvlanType {
+				// the slave is attached to another parent, replace it
+				if err := ns.NlHandle().LinkDel(link); err != nil {
+					return nil, types.InternalErrorf("failed to delete the stale %s link %s: %v", ipvlanType, endpoint.srcName, err)
+				}
+			}
+		}
 	}
-	// create the netlink ipvlan interface
-	vethName, err := createIPVlan(containerIfName, n.config.Parent, n.config.IpvlanMode)
-	if err != nil {
-		return nil, err
+	if vethName == "" {
+		// generate a name for the iface that will be renamed to eth0 in the sbox
+		containerIfName, err := netutils.GenerateIfaceName(ns.NlHandle(), vethPrefix, vethLen)
+		if err != nil {
+			return nil, types.InternalErrorf("error generating an interface name: %v", err)
+		}
+		// create the netlink ipvlan interface
+		vethName, err = createIPVlan(containerIfName, n.config.Parent, n.config.IpvlanMode, n.config.IpvlanFlag, n.config.Mtu)
+		if err != nil {
+			return nil, err
+		}
 	}
-	// bind the generated iface name to the endpoint
+	// bind the generated iface name and index to the endpoint
 	endpoint.srcName = vethName
+	if link, err := ns.NlHandle().LinkByName(vethName); err == nil {
+		endpoint.ifIndex = link.Attrs().Index
+	}
 	ep := n.endpoint(r.EndpointID)
 	if ep == nil {
-		return nil, fmt.Errorf("could not find endpoint with id %s", r.EndpointID)
+		return nil, types.NotFoundErrorf("could not find endpoint with id %s", r.EndpointID)
 	}
 
 	response := &api.JoinResponse{
@@ -60,81 +82,153 @@ func (d *driver) Join(r *api.JoinRequest) (*api.JoinResponse, error) {
 		},
 	}
 
-	if n.config.IpvlanMode == modeL3 {
+	if err := n.setJoinInfo(ep, response); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Ipvlan Endpoint %s Joined with Gateway: %q, GatewayIPv6: %q, Routes: %v, Ipvlan_Mode: %s, Parent: %s",
+		ep.id[0:7], response.Gateway, response.GatewayIPv6, response.StaticRoutes, n.config.IpvlanMode, n.config.Parent)
+
+	if err = d.storeUpdate(ep); err != nil {
+		return nil, types.InternalErrorf("failed to save ipvlan endpoint %s to store: %v", ep.id[0:7], err)
+	}
+
+	return response, nil
+}
+
+// Leave method is invoked when a Sandbox detaches from an endpoint.
+func (d *driver) Leave(r *api.LeaveRequest) error {
+	defer osl.InitOSContext()()
+	d.linkMu.RLock()
+	defer d.linkMu.RUnlock()
+	network, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	endpoint, err := network.getEndpoint(r.EndpointID)
+	if err != nil {
+		return err
+	}
+	if endpoint == nil {
+		return types.NotFoundErrorf("could not find endpoint with id %s", r.EndpointID)
+	}
+	if endpoint.srcName != "" {
+		if link, err := ns.NlHandle().LinkByName(endpoint.srcName); err == nil {
+			// the name may have been taken by another link once the slave was gone
+			if isIPVlanSlave(link, network.config.Parent) {
+				if err := ns.NlHandle().LinkDel(link); err != nil {
+					return types.InternalErrorf("failed to delete the %s link %s: %v", ipvlanType, endpoint.srcName, err)
+				}
+			} else {
+				logrus.Warnf("Link %s of endpoint %s is not an %s slave of %s, leaving it in place",
+					endpoint.srcName, r.EndpointID, ipvlanType, network.config.Parent)
+			}
+			endpoint.srcName = ""
+			endpoint.ifIndex = 0
+		} else {
+			// the link is still owned by the sandbox, which hands it back to the host
+			// namespace after the leave. DeleteEndpoint deletes it or the next Join reuses it.
+			logrus.Debugf("Ipvlan link %s of endpoint %s is held by the sandbox", endpoint.srcName, r.EndpointID)
+		}
+	}
+	if err := d.storeUpdate(endpoint); err != nil {
+		return types.InternalErrorf("failed to save ipvlan endpoint %s to store: %v", endpoint.id[0:7], err)
+	}
+
+	return nil
+}
+
+// setJoinInfo binds the gateways and static routes handed to the endpoint sandbox
+func (n *network) setJoinInfo(ep *endpoint, res *api.JoinResponse) error {
+	// endpoints of internal networks only reach their own segment
+	if n.config.Internal {
+		return nil
+	}
+	if n.config.IpvlanMode == modeL3 || n.config.IpvlanMode == modeL3S {
 		// disable gateway services to add a default gw using dev eth0 only
 		//jinfo.DisableGatewayService()
-		response.StaticRoutes = append(response.StaticRoutes, defaultV4Route)
-		logrus.Debugf("Ipvlan Endpoint Joined with IPv4_Addr: %s, Ipvlan_Mode: %s, Parent: %s",
-			ep.addr.IP.String(), n.config.IpvlanMode, n.config.Parent)
-		// If the endpoint has a v6 address, set a v6 default route
+		// set the default route of each address family the endpoint has, the other
+		// subnets of the network are reached through eth0 from the endpoint address
+		if ep.addr != nil {
+			if _, err := n.getSubnetforIPv4(ep.addr); err != nil {
+				return types.BadRequestErrorf("could not find a valid ipv4 subnet for endpoint %s: %v", ep.id, err)
+			}
+			res.StaticRoutes = append(res.StaticRoutes, connectedRoutes(ep.addr, n.config.ipv4SubnetIPs())...)
+			res.StaticRoutes = append(res.StaticRoutes, defaultV4Route)
+		}
 		if ep.addrv6 != nil {
-			response.StaticRoutes = append(response.StaticRoutes, defaultV6Route)
-			logrus.Debugf("Ipvlan Endpoint Joined with IPv6_Addr: %s, Ipvlan_Mode: %s, Parent: %s",
-				ep.addrv6.IP.String(), n.config.IpvlanMode, n.config.Parent)
+			if _, err := n.getSubnetforIPv6(ep.addrv6); err != nil {
+				return types.BadRequestErrorf("could not find a valid ipv6 subnet for endpoint %s: %v", ep.id, err)
+			}
+			res.StaticRoutes = append(res.StaticRoutes, connectedRoutes(ep.addrv6, n.config.ipv6SubnetIPs())...)
+			res.StaticRoutes = append(res.StaticRoutes, defaultV6Route)
 		}
 	}
 	if n.config.IpvlanMode == modeL2 {
+		// a leased address uses the router handed out with the lease
+		if gw := n.driver.leaseRouter(ep.id); gw != nil {
+			res.Gateway = gw.String()
+		}
 		// parse and correlate the endpoint v4 address with the available v4 subnets
-		if len(n.config.Ipv4Subnets) > 0 {
-			s := n.getSubnetforIPv4(ep.addr)
-			if s == nil {
-				return nil, fmt.Errorf("could not find a valid ipv4 subnet for endpoint %s", r.EndpointID)
+		if len(n.config.Ipv4Subnets) > 0 && ep.addr != nil {
+			s, err := n.getSubnetforIPv4(ep.addr)
+			if err != nil {
+				return types.BadRequestErrorf("could not find a valid ipv4 subnet for endpoint %s: %v", ep.id, err)
 			}
 			v4gw, _, err := net.ParseCIDR(s.GwIP)
 			if err != nil {
-				return nil, fmt.Errorf("gatway %s is not a valid ipv4 address: %v", s.GwIP, err)
+				return types.BadRequestErrorf("gatway %s is not a valid ipv4 address: %v", s.GwIP, err)
 			}
-			response.Gateway = v4gw.String()
-			logrus.Debugf("Ipvlan Endpoint Joined with IPv4_Addr: %s, Gateway: %s, Ipvlan_Mode: %s, Parent: %s",
-				ep.addr.IP.String(), v4gw.String(), n.config.IpvlanMode, n.config.Parent)
+			res.Gateway = v4gw.String()
 		}
 		// parse and correlate the endpoint v6 address with the available v6 subnets
-		if len(n.config.Ipv6Subnets) > 0 {
-			s := n.getSubnetforIPv6(ep.addrv6)
-			if s == nil {
-				return nil, fmt.Errorf("could not find a valid ipv6 subnet for endpoint %s", r.EndpointID)
+		if len(n.config.Ipv6Subnets) > 0 && ep.addrv6 != nil {
+			s, err := n.getSubnetforIPv6(ep.addrv6)
+			if err != nil {
+				return types.BadRequestErrorf("could not find a valid ipv6 subnet for endpoint %s: %v", ep.id, err)
 			}
 			v6gw, _, err := net.ParseCIDR(s.GwIP)
 			if err != nil {
-				return nil, fmt.Errorf("gatway %s is not a valid ipv6 address: %v", s.GwIP, err)
+				return types.BadRequestErrorf("gatway %s is not a valid ipv6 address: %v", s.GwIP, err)
 			}
-			response.GatewayIPv6 = v6gw.String()
-			logrus.Debugf("Ipvlan Endpoint Joined with IPv6_Addr: %s, Gateway: %s, Ipvlan_Mode: %s, Parent: %s",
-				ep.addrv6.IP.String(), v6gw.String(), n.config.IpvlanMode, n.config.Parent)
+			res.GatewayIPv6 = v6gw.String()
 		}
 	}
-
-	if err = d.storeUpdate(ep); err != nil {
-		return nil, fmt.Errorf("failed to save ipvlan endpoint %s to store: %v", ep.id[0:7], err)
+	// custom routes of the address families the endpoint has
+	for _, r := range n.config.Routes {
+		_, dst, err := net.ParseCIDR(r.Destination)
+		if err != nil {
+			return types.BadRequestErrorf("route destination %s is not valid: %v", r.Destination, err)
+		}
+		if (dst.IP.To4() != nil && ep.addr == nil) || (dst.IP.To4() == nil && ep.addrv6 == nil) {
+			continue
+		}
+		res.StaticRoutes = append(res.StaticRoutes, r.apiRoute())
 	}
 
-	return response, nil
+	return nil
 }
 
-// Leave method is invoked when a Sandbox detaches from an endpoint.
-func (d *driver) Leave(r *api.LeaveRequest) error {
-	defer osl.InitOSContext()()
-	network, err := d.getNetwork(r.NetworkID)
-	if err != nil {
-		return err
-	}
-	endpoint, err := network.getEndpoint(r.EndpointID)
-	if err != nil {
-		return err
-	}
-	if endpoint == nil {
-		return fmt.Errorf("could not find endpoint with id %s", r.EndpointID)
+// connectedRoutes returns the connected routes to the subnets not holding the endpoint
+// address, the subnet of the address is connected by the address itself
+func connectedRoutes(addr *net.IPNet, subnets []string) []api.StaticRoute {
+	var routes []api.StaticRoute
+	for _, s := range subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil || subnet.Contains(addr.IP) {
+			continue
+		}
+		routes = append(routes, api.StaticRoute{Destination: subnet.String(), RouteType: types.CONNECTED})
 	}
 
-	return nil
+	return routes
 }
 
 // getSubnetforIPv4 returns the ipv4 subnet to which the given IP belongs
-func (n *network) getSubnetforIPv4(ip *net.IPNet) *ipv4Subnet {
+func (n *network) getSubnetforIPv4(ip *net.IPNet) (*ipv4Subnet, error) {
 	for _, s := range n.config.Ipv4Subnets {
 		_, snet, err := net.ParseCIDR(s.SubnetIP)
 		if err != nil {
-			return nil
+			return nil, types.BadRequestErrorf("invalid ipv4 subnet %s: %v", s.SubnetIP, err)
 		}
 		// first check if the mask lengths are the same
 		i, _ := snet.Mask.Size()
@@ -143,19 +237,19 @@ func (n *network) getSubnetforIPv4(ip *net.IPNet) *ipv4Subnet {
 			continue
 		}
 		if snet.Contains(ip.IP) {
-			return s
+			return s, nil
 		}
 	}
 
-	return nil
+	return nil, types.BadRequestErrorf("address %s is not in an ipv4 subnet of network %s", ip, n.id)
 }
 
 // getSubnetforIPv6 returns the ipv6 subnet to which the given IP belongs
-func (n *network) getSubnetforIPv6(ip *net.IPNet) *ipv6Subnet {
+func (n *network) getSubnetforIPv6(ip *net.IPNet) (*ipv6Subnet, error) {
 	for _, s := range n.config.Ipv6Subnets {
 		_, snet, err := net.ParseCIDR(s.SubnetIP)
 		if err != nil {
-			return nil
+			return nil, types.BadRequestErrorf("invalid ipv6 subnet %s: %v", s.SubnetIP, err)
 		}
 		// first check if the mask lengths are the same
 		i, _ := snet.Mask.Size()
@@ -164,9 +258,9 @@ func (n *network) getSubnetforIPv6(ip *net.IPNet) *ipv6Subnet {
 			continue
 		}
 		if snet.Contains(ip.IP) {
-			return s
+			return s, nil
 		}
 	}
 
-	return nil
+	return nil, types.BadRequestErrorf("address %s is not in an ipv6 subnet of network %s", ip, n.id)
 }
@@ -0,0 +1,216 @@
+package ipvlan
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/testutils"
+	"github.com/docker/libnetwork/types"
+)
+
+// countSlaves returns the number of ipvlan slaves attached to the parent link
+func countSlaves(t *testing.T, parent string) int {
+	links, err := ns.NlHandle().LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, link := range links {
+		if isIPVlanSlave(link, parent) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// TestJoinLeave tests repeated join and leave cycles neither leak nor duplicate slave links,
+// and leave only deletes the slave links of the network
+func TestJoinLeave(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	d, err := NewDriver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "192.168.30.0/24", nil)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	err = d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "192.168.30.0/24", nil))
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatalf("expected a conflict error creating the network twice, got %v", err)
+	}
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.30.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	n := d.network(testNetworkID)
+	ep := n.endpoint(testEndpointID)
+	join := &api.JoinRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}
+	leave := &api.LeaveRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}
+
+	for i := 0; i < 3; i++ {
+		res, err := d.Join(join)
+		if err != nil {
+			t.Fatalf("join %d failed: %v", i, err)
+		}
+		// a retried join must hand back the same link
+		retry, err := d.Join(join)
+		if err != nil {
+			t.Fatalf("retried join %d failed: %v", i, err)
+		}
+		if retry.InterfaceName.SrcName != res.InterfaceName.SrcName {
+			t.Fatalf("retried join created %s instead of reusing %s", retry.InterfaceName.SrcName, res.InterfaceName.SrcName)
+		}
+		if ep.srcName != res.InterfaceName.SrcName {
+			t.Fatalf("expected endpoint bound to %s, got %s", res.InterfaceName.SrcName, ep.srcName)
+		}
+		if c := countSlaves(t, n.config.Parent); c != 1 {
+			t.Fatalf("expected 1 slave link after join %d, found %d", i, c)
+		}
+
+		if err := d.Leave(leave); err != nil {
+			t.Fatalf("leave %d failed: %v", i, err)
+		}
+		if ep.srcName != "" {
+			t.Fatalf("expected endpoint to be unbound after leave, still bound to %s", ep.srcName)
+		}
+		if parentExists(res.InterfaceName.SrcName) {
+			t.Fatalf("link %s was not deleted on leave", res.InterfaceName.SrcName)
+		}
+		if c := countSlaves(t, n.config.Parent); c != 0 {
+			t.Fatalf("expected no slave links after leave %d, found %d", i, c)
+		}
+	}
+
+	// a link that took the name of the endpoint link is not deleted
+	if _, err := d.Join(join); err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	name := ep.srcName
+	link, err := ns.NlHandle().LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.NlHandle().LinkDel(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := createDummyLink(name, name, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Leave(leave); err != nil {
+		t.Fatalf("failed to leave: %v", err)
+	}
+	if !parentExists(name) {
+		t.Fatalf("leave deleted link %s which is not a slave of the network parent", name)
+	}
+}
+
+// TestEndpointOperInfo tests the endpoint info reports the link of a joined endpoint and
+// forgets it on leave
+func TestEndpointOperInfo(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	d, err := NewDriver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "192.168.31.0/24", map[string]interface{}{mtuOpt: "1400"})); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.31.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	res, err := d.Join(&api.JoinRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	link, err := ns.NlHandle().LinkByName(res.InterfaceName.SrcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &api.EndpointInfoRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}
+	joined, err := d.EndpointOperInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"SrcName":     link.Attrs().Name,
+		"IfIndex":     link.Attrs().Index,
+		"Parent":      d.network(testNetworkID).config.Parent,
+		"IpvlanMode":  modeL2,
+		"IpvlanFlag":  flagBridge,
+		"Mtu":         1400,
+		"IPv4Address": "192.168.31.2/24",
+	}
+	for key, value := range expected {
+		if joined.Value[key] != value {
+			t.Fatalf("expected %s %v in the endpoint info, got %v", key, value, joined.Value[key])
+		}
+	}
+
+	if err := d.Leave(&api.LeaveRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+		t.Fatalf("failed to leave: %v", err)
+	}
+	left, err := d.EndpointOperInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left.Value["SrcName"] != "" || left.Value["IfIndex"] != 0 {
+		t.Fatalf("expected no link after leave, got %v index %v", left.Value["SrcName"], left.Value["IfIndex"])
+	}
+}
+
+// TestL3MultipleSubnets tests l3 endpoints get connected routes to the other subnets of the network
+func TestL3MultipleSubnets(t *testing.T) {
+	n := &network{
+		id:     testNetworkID,
+		driver: &driver{leases: map[string]*dhcpLease{}},
+		config: &configuration{
+			IpvlanMode:  modeL3,
+			Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "10.1.0.0/24"}, {SubnetIP: "10.2.0.0/24"}, {SubnetIP: "10.3.0.0/24"}},
+			Ipv6Subnets: []*ipv6Subnet{{SubnetIP: "2001:db8:1::/64"}},
+		},
+	}
+	ep := &endpoint{id: testEndpointID}
+	var err error
+	if ep.addr, err = types.ParseCIDR("10.2.0.5/24"); err != nil {
+		t.Fatal(err)
+	}
+	if ep.addrv6, err = types.ParseCIDR("2001:db8:1::5/64"); err != nil {
+		t.Fatal(err)
+	}
+	res := &api.JoinResponse{}
+	if err := n.setJoinInfo(ep, res); err != nil {
+		t.Fatal(err)
+	}
+	expected := []api.StaticRoute{
+		{Destination: "10.1.0.0/24", RouteType: types.CONNECTED},
+		{Destination: "10.3.0.0/24", RouteType: types.CONNECTED},
+		defaultV4Route,
+		defaultV6Route,
+	}
+	if !reflect.DeepEqual(res.StaticRoutes, expected) {
+		t.Fatalf("expected routes %v, got %v", expected, res.StaticRoutes)
+	}
+
+	// an address outside of the network subnets is reported
+	if ep.addr, err = types.ParseCIDR("10.4.0.5/24"); err != nil {
+		t.Fatal(err)
+	}
+	err = n.setJoinInfo(ep, &api.JoinResponse{})
+	if _, ok := err.(types.BadRequestError); !ok {
+		t.Fatalf("expected a bad request error for an address outside of the network subnets, got %v", err)
+	}
+}
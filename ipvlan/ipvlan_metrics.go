@@ -0,0 +1,121 @@
+package ipvlan
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "ipvlan"
+	metricsPath      = "/metrics"
+	outcomeSuccess   = "success"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Plugin requests served by operation and outcome.",
+	}, []string{"operation", "outcome"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the plugin requests by operation and outcome.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"operation", "outcome"})
+
+	netlinkFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "netlink_failures_total",
+		Help:      "Failed netlink calls creating the ipvlan, vlan and dummy links.",
+	}, []string{"operation"})
+
+	storeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "store_errors_total",
+		Help:      "Failed datastore operations.",
+	}, []string{"operation"})
+
+	networksDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "networks"),
+		"Networks by parent link and ipvlan mode.", []string{"parent", "mode"}, nil)
+
+	endpointsDesc = prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "endpoints"),
+		"Endpoints by parent link and ipvlan mode.", []string{"parent", "mode"}, nil)
+)
+
+// NewMetricsHandler serves the prometheus metrics of the driver and its plugin requests on /metrics
+func NewMetricsHandler(d *driver) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(requestsTotal, requestDuration, netlinkFailures, storeErrors,
+		&stateCollector{d: d}, prometheus.NewGoCollector())
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// stateCollector reports the networks and endpoints of the networkTable at scrape time
+type stateCollector struct {
+	d *driver
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- networksDesc
+	ch <- endpointsDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	type link struct{ parent, mode string }
+	networks := map[link]int{}
+	endpoints := map[link]int{}
+	for _, n := range c.d.getNetworks() {
+		l := link{n.config.Parent, n.config.IpvlanMode}
+		networks[l]++
+		n.Lock()
+		endpoints[l] += len(n.endpoints)
+		n.Unlock()
+	}
+	for l, count := range networks {
+		ch <- prometheus.MustNewConstMetric(networksDesc, prometheus.GaugeValue, float64(count), l.parent, l.mode)
+		ch <- prometheus.MustNewConstMetric(endpointsDesc, prometheus.GaugeValue, float64(endpoints[l]), l.parent, l.mode)
+	}
+}
+
+// requestOutcome names the outcome of a request after the error class of its status
+func requestOutcome(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return outcomeSuccess
+	case status == http.StatusBadRequest:
+		return errClassBadRequest
+	case status == http.StatusForbidden:
+		return errClassForbidden
+	case status == http.StatusNotFound:
+		return errClassNotFound
+	case status == http.StatusConflict:
+		return errClassConflict
+	case status == http.StatusNotImplemented:
+		return errClassNotImplemented
+	case status == http.StatusServiceUnavailable:
+		return errClassRetry
+	}
+	return errClassInternal
+}
+
+// withMetrics counts the requests of the plugin path and measures their latency
+func withMetrics(path string, next http.HandlerFunc) http.HandlerFunc {
+	operation := strings.TrimPrefix(path, "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		outcome := requestOutcome(rec.status)
+		requestsTotal.WithLabelValues(operation, outcome).Inc()
+		requestDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,60 @@
+package ipvlan
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/types"
+)
+
+// TestMetrics tests the state of the networks and the outcome of the plugin requests,
+// including the ones refused while draining, are exported
+func TestMetrics(t *testing.T) {
+	d := &driver{networks: networkTable{
+		"n1": {id: "n1", config: &configuration{Parent: "eth0", IpvlanMode: modeL2},
+			endpoints: endpointTable{"e1": {id: "e1"}, "e2": {id: "e2"}}},
+		"n2": {id: "n2", config: &configuration{Parent: "eth0", IpvlanMode: modeL2},
+			endpoints: endpointTable{"e3": {id: "e3"}}},
+		"n3": {id: "n3", config: &configuration{Parent: "eth1", IpvlanMode: modeL3},
+			endpoints: endpointTable{}},
+	}}
+
+	h := NewHandler(&fakeDriver{err: types.NotFoundErrorf("network not found")})
+	url, stop := serveTestHandler(h)
+	defer stop()
+	postTestRequest(t, url, deleteNetworkPath, &api.DeleteNetworkRequest{NetworkID: testNetworkID})
+	postTestBody(t, url, createNetworkPath, "{")
+	// the requests refused while draining are counted too
+	drained := NewHandler(&fakeDriver{})
+	drainedURL, stopDrained := serveTestHandler(drained)
+	defer stopDrained()
+	if err := drained.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	postTestRequest(t, drainedURL, leavePath, &api.LeaveRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+
+	rec := httptest.NewRecorder()
+	NewMetricsHandler(d).ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`ipvlan_networks{mode="l2",parent="eth0"} 2`,
+		`ipvlan_networks{mode="l3",parent="eth1"} 1`,
+		`ipvlan_endpoints{mode="l2",parent="eth0"} 3`,
+		`ipvlan_endpoints{mode="l3",parent="eth1"} 0`,
+		`ipvlan_requests_total{operation="NetworkDriver.DeleteNetwork",outcome="not_found"}`,
+		`ipvlan_requests_total{operation="NetworkDriver.CreateNetwork",outcome="bad_request"}`,
+		`ipvlan_request_duration_seconds_count{operation="NetworkDriver.DeleteNetwork",outcome="not_found"}`,
+		`ipvlan_requests_total{operation="NetworkDriver.Leave",outcome="retry"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected %s in the metrics, got\n%s", expected, body)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package ipvlan
 
 import (
-	"fmt"
+	"net"
+	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/parsers/kernel"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/datastore"
 	"github.com/docker/libnetwork/driverapi"
 	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/osl"
+	"github.com/docker/libnetwork/types"
 	"github.com/docker/libnetwork/drivers/remote/api"
 )
 
@@ -18,27 +22,60 @@ func (d *driver) CreateNetwork(r *api.CreateNetworkRequest) error {
 
 	kv, err := kernel.GetKernelVersion()
 	if err != nil {
-		return fmt.Errorf("Failed to check kernel version for %s driver support: %v", ipvlanType, err)
+		return types.InternalErrorf("Failed to check kernel version for %s driver support: %v", ipvlanType, err)
 	}
 	// ensure Kernel version is >= v4.2 for ipvlan support
 	if kv.Kernel < ipvlanKernelVer || (kv.Kernel == ipvlanKernelVer && kv.Major < ipvlanMajorVer) {
-		return fmt.Errorf("kernel version failed to meet the minimum ipvlan kernel requirement of %d.%d, found %d.%d.%d",
+		return types.NotImplementedErrorf("kernel version failed to meet the minimum ipvlan kernel requirement of %d.%d, found %d.%d.%d",
 			ipvlanKernelVer, ipvlanMajorVer, kv.Kernel, kv.Major, kv.Minor)
 	}
-	// reject a null v4 network
-	if len(r.IPv4Data) == 0 || r.IPv4Data[0].Pool.String() == "0.0.0.0/0" {
-		return fmt.Errorf("ipv4 pool is empty")
+	if _, err := d.getNetwork(r.NetworkID); err == nil {
+		return conflictErrorf("network %s already exists", stringid.TruncateID(r.NetworkID))
 	}
 	// parse and validate the config and bind to networkConfiguration
 	config, err := parseNetworkOptions(r.NetworkID, stringOptions(r.Options))
 	if err != nil {
 		return err
 	}
+	// reject a null v4 network unless it is ipv6-only or the v4 addresses are leased over dhcp
+	ipv4Data := r.IPv4Data
+	if len(ipv4Data) == 0 || ipv4Data[0].Pool.String() == "0.0.0.0/0" {
+		if !config.Dhcp && len(r.IPv6Data) == 0 {
+			return types.BadRequestErrorf("ipv4 pool is empty")
+		}
+		// the null ipam pool carries no addressing
+		ipv4Data = nil
+	}
 	config.ID = r.NetworkID
-	err = config.processIPAM(r.NetworkID, r.IPv4Data, r.IPv6Data)
+	// --internal networks have no external connectivity, whatever their parent
+	if internalOption(r.Options) {
+		config.Internal = true
+	}
+	// in global scope the configuration allocated by the swarm manager is shared by every host
+	if d.scope == GlobalScope {
+		shared, err := d.getGlobalConfig(r.NetworkID)
+		if err != nil {
+			logrus.Debugf("no shared configuration found for global network %s: %v", r.NetworkID, err)
+		} else {
+			config.inherit(shared)
+		}
+	}
+	err = config.processIPAM(r.NetworkID, ipv4Data, r.IPv6Data)
 	if err != nil {
 		return err
 	}
+	if err := config.checkSubnetsDisjoint(); err != nil {
+		return err
+	}
+	if config.HostAccess {
+		// the reserved address is per network, every host of a global network would share it
+		if d.scope == GlobalScope {
+			return types.BadRequestErrorf("-o %s is not supported by the %s scope", hostAccessOpt, GlobalScope)
+		}
+		if config.HostAddress, err = hostAccessAddress(ipv4Data); err != nil {
+			return err
+		}
+	}
 	// verify the ipvlan mode from -o ipvlan_mode option
 	switch config.IpvlanMode {
 	case "", modeL2:
@@ -46,12 +83,46 @@ func (d *driver) CreateNetwork(r *api.CreateNetworkRequest) error {
 		config.IpvlanMode = modeL2
 	case modeL3:
 		config.IpvlanMode = modeL3
+	case modeL3S:
+		// ensure Kernel version is >= v4.9 for ipvlan l3s support
+		if !kernelAtLeast(kv, l3sKernelVer, l3sMajorVer) {
+			return types.NotImplementedErrorf("ipvlan mode '%s' requires kernel %d.%d or later, found %d.%d.%d",
+				modeL3S, l3sKernelVer, l3sMajorVer, kv.Kernel, kv.Major, kv.Minor)
+		}
+		config.IpvlanMode = modeL3S
+	default:
+		return types.BadRequestErrorf("requested ipvlan mode '%s' is not valid, 'l2' mode is the ipvlan driver default", config.IpvlanMode)
+	}
+	// verify the ipvlan flag from -o ipvlan_flag option
+	switch config.IpvlanFlag {
+	case "", flagBridge:
+		// default to ipvlan bridge flag if -o ipvlan_flag is empty
+		config.IpvlanFlag = flagBridge
+	case flagPrivate, flagVepa:
+		// ensure Kernel version is >= v4.15 for ipvlan private and vepa support
+		if !kernelAtLeast(kv, flagKernelVer, flagMajorVer) {
+			return types.NotImplementedErrorf("ipvlan flag '%s' requires kernel %d.%d or later, found %d.%d.%d",
+				config.IpvlanFlag, flagKernelVer, flagMajorVer, kv.Kernel, kv.Major, kv.Minor)
+		}
 	default:
-		return fmt.Errorf("requested ipvlan mode '%s' is not valid, 'l2' mode is the ipvlan driver default", config.IpvlanMode)
+		return types.BadRequestErrorf("requested ipvlan flag '%s' is not valid, 'bridge' is the ipvlan driver default", config.IpvlanFlag)
 	}
 	// loopback is not a valid parent link
 	if config.Parent == "lo" {
-		return fmt.Errorf("loopback interface is not a valid %s parent link", ipvlanType)
+		return types.BadRequestErrorf("loopback interface is not a valid %s parent link", ipvlanType)
+	}
+	// private slaves can not be reached by the host access slave
+	if config.HostAccess && config.IpvlanFlag == flagPrivate {
+		return types.BadRequestErrorf("-o %s can not be used with ipvlan flag '%s'", hostAccessOpt, flagPrivate)
+	}
+	// dhcp leases are requested on the segment of the parent link
+	if config.Dhcp {
+		if config.IpvlanMode != modeL2 {
+			return types.BadRequestErrorf("dhcp is only supported in ipvlan mode '%s'", modeL2)
+		}
+		if config.Parent == "" {
+			return types.BadRequestErrorf("dhcp requires a -o %s interface", parentOpt)
+		}
 	}
 	// if parent interface not specified, create a dummy type link to use named dummy+net_id
 	if config.Parent == "" {
@@ -59,6 +130,9 @@ func (d *driver) CreateNetwork(r *api.CreateNetworkRequest) error {
 		// empty parent and --internal are handled the same. Set here to update k/v
 		config.Internal = true
 	}
+	if err := config.validateRoutes(); err != nil {
+		return err
+	}
 	err = d.createNetwork(config)
 	if err != nil {
 		return err
@@ -66,10 +140,26 @@ func (d *driver) CreateNetwork(r *api.CreateNetworkRequest) error {
 	// update persistent db, rollback on fail
 	err = d.storeUpdate(config)
 	if err != nil {
+		config.delInternalRules()
+		if config.HostAccess {
+			if err := config.delHostShim(); err != nil {
+				logrus.Debugf("continuing the network create rollback: %v", err)
+			}
+		}
 		d.deleteNetwork(config.ID)
 		logrus.Debugf("encoutered an error rolling back a network create for %s : %v", config.ID, err)
 		return err
 	}
+	// docker configures the resolv.conf of the containers from its own --dns flags only
+	if len(config.DNS)+len(config.DNSSearch)+len(config.DNSOptions) > 0 {
+		logrus.Warnf("The -o %s, %s and %s options of network %s are only reported by the endpoint info, containers do not get them, pass --dns, --dns-search and --dns-option to docker run instead",
+			dnsOpt, dnsSearchOpt, dnsOptionsOpt, stringid.TruncateID(config.ID))
+	}
+	// the bgp speaker only announces ipv4 prefixes, the v6 endpoints are not exported
+	if d.announcer != nil && config.routed() && len(config.Ipv6Subnets) > 0 {
+		logrus.Warnf("The ipv6 subnets %v of network %s are not announced over bgp, only ipv4 prefixes are exported",
+			config.ipv6SubnetIPs(), stringid.TruncateID(config.ID))
+	}
 
 	return nil
 }
@@ -94,58 +184,221 @@ func stringOptions(options map[string]interface{}) map[string]string {
 
 // createNetwork is used by new network callbacks and persistent network cache
 func (d *driver) createNetwork(config *configuration) error {
-	networkList := d.getNetworks()
-	for _, nw := range networkList {
-		if config.Parent == nw.config.Parent {
-			return fmt.Errorf("network %s is already using parent interface %s",
-				getDummyName(stringid.TruncateID(nw.config.ID)), config.Parent)
+	// the networks sharing the parent are checked and the network added under the same lock,
+	// concurrent creates on a parent would both pass the checks otherwise
+	d.Lock()
+	defer d.Unlock()
+	for _, nw := range d.networks {
+		if config.Parent != nw.config.Parent {
+			continue
+		}
+		// the kernel applies the ipvlan mode and flag to every slave of a parent
+		if config.IpvlanMode != nw.config.IpvlanMode || config.IpvlanFlag != nw.config.IpvlanFlag {
+			return conflictErrorf("network %s is already using parent interface %s with ipvlan mode %s and flag %s, it can not be shared with mode %s and flag %s",
+				stringid.TruncateID(nw.config.ID), config.Parent, nw.config.IpvlanMode, nw.config.IpvlanFlag,
+				config.IpvlanMode, config.IpvlanFlag)
+		}
+		if err := config.checkSubnetOverlap(nw.config); err != nil {
+			return err
+		}
+		// a parent link created by the driver is shared, the last network using it deletes it
+		if nw.config.CreatedSlaveLink {
+			config.CreatedSlaveLink = true
+		}
+	}
+	// in global scope each host creates its parent link lazily with the first endpoint
+	if d.scope != GlobalScope {
+		if err := config.createParent(); err != nil {
+			return err
+		}
+	}
+	if config.HostAccess {
+		if err := config.createHostShim(); err != nil {
+			return err
+		}
+	}
+	if err := config.addInternalRules(); err != nil {
+		// the host access link is left behind by a failed create otherwise
+		if config.HostAccess {
+			if err := config.delHostShim(); err != nil {
+				logrus.Debugf("continuing the network create rollback: %v", err)
+			}
 		}
+		return err
+	}
+	n := &network{
+		id:        config.ID,
+		driver:    d,
+		endpoints: endpointTable{},
+		config:    config,
 	}
+	// add the *network
+	d.networks[n.id] = n
+
+	return nil
+}
+
+// createParent creates the parent link of the network when it does not exist on the host
+func (config *configuration) createParent() error {
 	if !parentExists(config.Parent) {
-		// if the --internal flag is set, create a dummy link
-		if config.Internal {
-			err := createDummyLink(config.Parent, getDummyName(stringid.TruncateID(config.ID)))
+		// if the parent was not specified, create a dummy link
+		if config.Parent == getDummyName(stringid.TruncateID(config.ID)) {
+			err := createDummyLink(config.Parent, getDummyName(stringid.TruncateID(config.ID)), config.Mtu)
 			if err != nil {
 				return err
 			}
 			config.CreatedSlaveLink = true
 			// notify the user in logs they have limited comunicatins
-			if config.Parent == getDummyName(stringid.TruncateID(config.ID)) {
-				logrus.Debugf("Empty -o parent= and --internal flags limit communications to other containers inside of network: %s",
-					config.Parent)
-			}
+			logrus.Debugf("Empty -o parent= limits communications to other containers inside of network: %s",
+				config.Parent)
 		} else {
 			// if the subinterface parent_iface.vlan_id checks do not pass, return err.
 			//  a valid example is 'eth0.10' for a parent iface 'eth0' with a vlan id '10'
-			err := createVlanLink(config.Parent)
+			err := createVlanLink(config.Parent, config.Mtu)
 			if err != nil {
 				return err
 			}
 			// if driver created the networks slave link, record it for future deletion
 			config.CreatedSlaveLink = true
 		}
+	} else if config.Mtu > 0 {
+		// reject an mtu the existing parent link can not carry
+		if err := validateParentMtu(config.Parent, config.Mtu); err != nil {
+			return err
+		}
 	}
-	n := &network{
-		id:        config.ID,
-		driver:    d,
-		endpoints: endpointTable{},
-		config:    config,
+
+	return nil
+}
+
+// ensureParent lazily creates the parent link of a global scope network on this host
+func (d *driver) ensureParent(n *network) error {
+	if d.scope != GlobalScope {
+		return nil
+	}
+	return d.createParent(n)
+}
+
+// createParent creates the missing parent link of the network, recording a parent link
+// created by the driver in the store for every network sharing it
+func (d *driver) createParent(n *network) error {
+	n.Lock()
+	created := n.config.CreatedSlaveLink
+	err := n.config.createParent()
+	changed := n.config.CreatedSlaveLink != created
+	n.Unlock()
+	if err != nil || !changed {
+		return err
+	}
+	// every network sharing the driver created parent link records it, the last of them
+	// deletes it
+	for _, nw := range d.getNetworks() {
+		if nw.config.Parent != n.config.Parent {
+			continue
+		}
+		nw.Lock()
+		nw.config.CreatedSlaveLink = true
+		nw.Unlock()
+		if err := d.storeUpdate(nw.config); err != nil {
+			return err
+		}
 	}
-	// add the *network
-	d.addNetwork(n)
 
 	return nil
 }
 
+// NetworkAllocate validates the options of a global scope network on the swarm manager
+// and shares the resulting configuration with every host through the global store
+func (d *driver) NetworkAllocate(id string, option map[string]string, ipV4Data, ipV6Data []driverapi.IPAMData) (map[string]string, error) {
+	if d.globalStore == nil {
+		return nil, types.NotImplementedErrorf("%s driver is not configured with a global store", ipvlanType)
+	}
+	config, err := parseNetworkOptions(id, option)
+	if err != nil {
+		return nil, err
+	}
+	config.ID = id
+	if err := config.processIPAM(id, ipV4Data, ipV6Data); err != nil {
+		return nil, err
+	}
+	if err := config.checkSubnetsDisjoint(); err != nil {
+		return nil, types.BadRequestErrorf("%v", err)
+	}
+	// the kernel support of the mode and flag is verified by every host on CreateNetwork
+	if config.IpvlanMode == "" {
+		config.IpvlanMode = modeL2
+	}
+	if _, err := setIPVlanMode(config.IpvlanMode); err != nil {
+		return nil, types.BadRequestErrorf("requested ipvlan mode '%s' is not valid: %v", config.IpvlanMode, err)
+	}
+	if config.IpvlanFlag == "" {
+		config.IpvlanFlag = flagBridge
+	}
+	if _, err := setIPVlanFlag(config.IpvlanFlag); err != nil {
+		return nil, types.BadRequestErrorf("requested ipvlan flag '%s' is not valid: %v", config.IpvlanFlag, err)
+	}
+	config.scope = datastore.GlobalScope
+	if err := d.storeUpdate(config); err != nil {
+		return nil, err
+	}
+	// hand the normalized options back so every host creates the network alike
+	opts := make(map[string]string, len(option)+2)
+	for k, v := range option {
+		opts[k] = v
+	}
+	opts[driverModeOpt] = config.IpvlanMode
+	opts[driverFlagOpt] = config.IpvlanFlag
+
+	return opts, nil
+}
+
+// NetworkFree removes the shared configuration of a global scope network
+func (d *driver) NetworkFree(id string) error {
+	if d.globalStore == nil {
+		return types.NotImplementedErrorf("%s driver is not configured with a global store", ipvlanType)
+	}
+	config, err := d.getGlobalConfig(id)
+	if err != nil {
+		if err == datastore.ErrKeyNotFound {
+			return nil
+		}
+		return types.InternalErrorf("failed to get the shared configuration of network %s: %v", id, err)
+	}
+
+	return d.storeDelete(config)
+}
+
+// AllocateNetwork allocates the cluster wide resources of a global scope network
+func (d *driver) AllocateNetwork(r *api.AllocateNetworkRequest) (*api.AllocateNetworkResponse, error) {
+	opts, err := d.NetworkAllocate(r.NetworkID, r.Options, r.IPv4Data, r.IPv6Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.AllocateNetworkResponse{Options: opts}, nil
+}
+
+// FreeNetwork frees the cluster wide resources of a global scope network
+func (d *driver) FreeNetwork(r *api.FreeNetworkRequest) error {
+	return d.NetworkFree(r.NetworkID)
+}
+
 // DeleteNetwork the network for the specified driver type
 func (d *driver) DeleteNetwork(r *api.DeleteNetworkRequest) error {
 	defer osl.InitOSContext()()
 	n := d.network(r.NetworkID)
 	if n == nil {
-		return fmt.Errorf("network id %s not found", r.NetworkID)
+		return types.NotFoundErrorf("network id %s not found", r.NetworkID)
+	}
+	n.config.delInternalRules()
+	// the host access link is a slave of the parent, delete it first
+	if n.config.HostAccess {
+		if err := n.config.delHostShim(); err != nil {
+			logrus.Debugf("continuing the delete network operation: %v", err)
+		}
 	}
-	// if the driver created the slave interface, delete it, otherwise leave it
-	if ok := n.config.CreatedSlaveLink; ok {
+	// if the driver created the slave interface and no other network shares it, delete it, otherwise leave it
+	if ok := n.config.CreatedSlaveLink; ok && d.parentRefs(n.config.Parent, r.NetworkID) == 0 {
 		// if the interface exists, only delete if it matches iface.vlan or dummy.net_id naming
 		if ok := parentExists(n.config.Parent); ok {
 			// only delete the link if it is named the net_id
@@ -165,12 +418,13 @@ func (d *driver) DeleteNetwork(r *api.DeleteNetworkRequest) error {
 			}
 		}
 	}
+	d.deleteReservations(r.NetworkID)
 	// delete the *network
 	d.deleteNetwork(r.NetworkID)
 	// delete the network record from persistent cache
 	err := d.storeDelete(n.config)
 	if err != nil {
-		return fmt.Errorf("error deleting deleting id %s from datastore: %v", r.NetworkID, err)
+		return types.InternalErrorf("error deleting deleting id %s from datastore: %v", r.NetworkID, err)
 	}
 	return nil
 }
@@ -198,13 +452,107 @@ func (config *configuration) fromOptions(labels map[string]string) error {
 		case driverModeOpt:
 			// parse driver option '-o ipvlan_mode'
 			config.IpvlanMode = value
+		case driverFlagOpt:
+			// parse driver option '-o ipvlan_flag'
+			config.IpvlanFlag = value
+		case dhcpOpt:
+			// parse driver option '-o dhcp'
+			dhcp, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid dhcp value %q: %v", value, err)
+			}
+			config.Dhcp = dhcp
+		case hostAccessOpt:
+			// parse driver option '-o host_access'
+			hostAccess, err := strconv.ParseBool(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid host_access value %q: %v", value, err)
+			}
+			config.HostAccess = hostAccess
+		case routesOpt:
+			// parse driver option '-o routes=10.0.0.0/8 via 192.168.1.1,...'
+			routes, err := parseRoutes(value)
+			if err != nil {
+				return err
+			}
+			config.Routes = routes
+		case dnsOpt:
+			// parse driver option '-o dns=10.0.0.53,10.0.1.53'
+			servers, err := parseDNSServers(value)
+			if err != nil {
+				return err
+			}
+			config.DNS = servers
+		case dnsSearchOpt:
+			// parse driver option '-o dns_search=example.com,...'
+			domains, err := parseDNSSearch(value)
+			if err != nil {
+				return err
+			}
+			config.DNSSearch = domains
+		case dnsOptionsOpt:
+			// parse driver option '-o dns_options=ndots:2,...'
+			options, err := parseDNSOptions(value)
+			if err != nil {
+				return err
+			}
+			config.DNSOptions = options
+		case netlabel.DriverMTU, mtuOpt:
+			// parse driver option '-o com.docker.network.driver.mtu' or '-o mtu'
+			mtu, err := strconv.Atoi(value)
+			if err != nil {
+				return types.BadRequestErrorf("invalid mtu value %q: %v", value, err)
+			}
+			if mtu < minMtu {
+				return types.BadRequestErrorf("invalid mtu %d, the minimum supported mtu is %d", mtu, minMtu)
+			}
+			config.Mtu = mtu
 		}
 	}
 	return nil
 }
 
+// inherit fills the options not passed on this host from the shared network configuration
+func (config *configuration) inherit(shared *configuration) {
+	if config.Parent == "" {
+		config.Parent = shared.Parent
+	}
+	if config.IpvlanMode == "" {
+		config.IpvlanMode = shared.IpvlanMode
+	}
+	if config.IpvlanFlag == "" {
+		config.IpvlanFlag = shared.IpvlanFlag
+	}
+	if config.Mtu == 0 {
+		config.Mtu = shared.Mtu
+	}
+	if len(config.Routes) == 0 {
+		config.Routes = shared.Routes
+	}
+	if !config.Dhcp {
+		config.Dhcp = shared.Dhcp
+	}
+	if len(config.DNS) == 0 {
+		config.DNS = shared.DNS
+	}
+	if len(config.DNSSearch) == 0 {
+		config.DNSSearch = shared.DNSSearch
+	}
+	if len(config.DNSOptions) == 0 {
+		config.DNSOptions = shared.DNSOptions
+	}
+}
+
 // processIPAM parses v4 and v6 IP information and binds it to the network configuration
 func (config *configuration) processIPAM(id string, ipamV4Data, ipamV6Data []driverapi.IPAMData) error {
+	config.DriverIpam = len(ipamV4Data)+len(ipamV6Data) > 0
+	for _, data := range [][]driverapi.IPAMData{ipamV4Data, ipamV6Data} {
+		for _, ipd := range data {
+			if ipd.AddressSpace != localAddressSpace && ipd.AddressSpace != globalAddressSpace {
+				config.DriverIpam = false
+			}
+		}
+	}
 	if len(ipamV4Data) > 0 {
 		for _, ipd := range ipamV4Data {
 			s := &ipv4Subnet{
@@ -225,3 +573,141 @@ func (config *configuration) processIPAM(id string, ipamV4Data, ipamV6Data []dri
 	}
 	return nil
 }
+
+// parseRoutes parses comma separated routes formatted as <destination> [via <next hop>]
+func parseRoutes(value string) ([]*staticRoute, error) {
+	var routes []*staticRoute
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 1 && (len(fields) != 3 || fields[1] != "via") {
+			return nil, types.BadRequestErrorf("invalid route %q, expected <destination> [via <next hop>]", entry)
+		}
+		_, dst, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, types.BadRequestErrorf("invalid destination of route %q: %v", entry, err)
+		}
+		route := &staticRoute{Destination: dst.String()}
+		if len(fields) == 3 {
+			nh := net.ParseIP(fields[2])
+			if nh == nil {
+				return nil, types.BadRequestErrorf("invalid next hop of route %q", entry)
+			}
+			if (nh.To4() == nil) != (dst.IP.To4() == nil) {
+				return nil, types.BadRequestErrorf("next hop and destination of route %q are not of the same family", entry)
+			}
+			route.NextHop = nh.String()
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// validateRoutes checks the routes can be installed in the endpoints of the network
+func (config *configuration) validateRoutes() error {
+	if len(config.Routes) == 0 {
+		return nil
+	}
+	if config.Internal {
+		return types.BadRequestErrorf("-o %s can not be used with --internal networks or networks without a -o %s", routesOpt, parentOpt)
+	}
+	// l2 endpoints resolve the next hops on the segment, l3 endpoints route through their link
+	if config.IpvlanMode != modeL2 || len(config.subnets()) == 0 {
+		return nil
+	}
+	for _, r := range config.Routes {
+		if r.NextHop == "" {
+			continue
+		}
+		onLink := false
+		for _, s := range config.subnets() {
+			if _, subnet, err := net.ParseCIDR(s); err == nil && subnet.Contains(net.ParseIP(r.NextHop)) {
+				onLink = true
+			}
+		}
+		if !onLink {
+			return types.BadRequestErrorf("next hop %s of route %s is not in a subnet of the network", r.NextHop, r.Destination)
+		}
+	}
+
+	return nil
+}
+
+// apiRoute returns the route handed to the endpoints
+func (r *staticRoute) apiRoute() api.StaticRoute {
+	if r.NextHop == "" {
+		return api.StaticRoute{Destination: r.Destination, RouteType: types.CONNECTED}
+	}
+	return api.StaticRoute{Destination: r.Destination, RouteType: types.NEXTHOP, NextHop: r.NextHop}
+}
+
+// checkSubnetsDisjoint returns an error if the subnets of the network overlap each other
+func (config *configuration) checkSubnetsDisjoint() error {
+	subnets := config.subnets()
+	for i, s := range subnets {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return types.BadRequestErrorf("invalid subnet %s: %v", s, err)
+		}
+		for _, o := range subnets[i+1:] {
+			if subnetsOverlap(s, o) {
+				return types.BadRequestErrorf("subnet %s overlaps with subnet %s of the same network", s, o)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkSubnetOverlap returns an error if a subnet of config overlaps with a subnet of other
+func (config *configuration) checkSubnetOverlap(other *configuration) error {
+	for _, s := range config.subnets() {
+		for _, o := range other.subnets() {
+			if subnetsOverlap(s, o) {
+				return conflictErrorf("subnet %s overlaps with subnet %s of network %s on parent interface %s",
+					s, o, stringid.TruncateID(other.ID), other.Parent)
+			}
+		}
+	}
+
+	return nil
+}
+
+// subnets returns the v4 and v6 subnets of the network configuration
+func (config *configuration) subnets() []string {
+	return append(config.ipv4SubnetIPs(), config.ipv6SubnetIPs()...)
+}
+
+// ipv4SubnetIPs returns the v4 subnets of the network in CIDR notation
+func (config *configuration) ipv4SubnetIPs() []string {
+	subnets := make([]string, 0, len(config.Ipv4Subnets))
+	for _, s := range config.Ipv4Subnets {
+		subnets = append(subnets, s.SubnetIP)
+	}
+	return subnets
+}
+
+// ipv6SubnetIPs returns the v6 subnets of the network in CIDR notation
+func (config *configuration) ipv6SubnetIPs() []string {
+	subnets := make([]string, 0, len(config.Ipv6Subnets))
+	for _, s := range config.Ipv6Subnets {
+		subnets = append(subnets, s.SubnetIP)
+	}
+	return subnets
+}
+
+// subnetsOverlap checks if the two subnets in CIDR notation share any address
+func subnetsOverlap(a, b string) bool {
+	_, na, err := net.ParseCIDR(a)
+	if err != nil {
+		return false
+	}
+	_, nb, err := net.ParseCIDR(b)
+	if err != nil {
+		return false
+	}
+
+	return na.Contains(nb.IP) || nb.Contains(na.IP)
+}
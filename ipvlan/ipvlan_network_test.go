@@ -0,0 +1,168 @@
+package ipvlan
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/types"
+)
+
+// TestMtuOption tests the mtu driver option and its docker label alias
+func TestMtuOption(t *testing.T) {
+	for _, label := range []string{mtuOpt, netlabel.DriverMTU} {
+		config := &configuration{}
+		if err := config.fromOptions(map[string]string{label: "9000"}); err != nil {
+			t.Fatalf("failed to parse %s: %v", label, err)
+		}
+		if config.Mtu != 9000 {
+			t.Fatalf("expected mtu 9000 from %s, got %d", label, config.Mtu)
+		}
+	}
+	for _, value := range []string{"jumbo", "-1", "0", "67"} {
+		config := &configuration{}
+		if err := config.fromOptions(map[string]string{mtuOpt: value}); err == nil {
+			t.Fatalf("invalid mtu %q should have returned an error", value)
+		}
+	}
+}
+
+// TestSubnetOverlap tests overlapping subnets of networks sharing a parent are detected
+func TestSubnetOverlap(t *testing.T) {
+	config := &configuration{
+		Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "192.168.1.0/24"}},
+		Ipv6Subnets: []*ipv6Subnet{{SubnetIP: "2001:db8:1::/64"}},
+	}
+	overlapping := []*configuration{
+		{Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "192.168.1.0/24"}}},
+		{Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "192.168.0.0/16"}}},
+		{Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "192.168.1.128/25"}}},
+		{Ipv6Subnets: []*ipv6Subnet{{SubnetIP: "2001:db8::/32"}}},
+	}
+	for _, other := range overlapping {
+		if err := config.checkSubnetOverlap(other); err == nil {
+			t.Fatalf("expected %v to overlap with %v", other.subnets(), config.subnets())
+		}
+	}
+	disjoint := []*configuration{
+		{Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "192.168.2.0/24"}}},
+		{Ipv6Subnets: []*ipv6Subnet{{SubnetIP: "2001:db8:2::/64"}}},
+		{},
+	}
+	for _, other := range disjoint {
+		if err := config.checkSubnetOverlap(other); err != nil {
+			t.Fatalf("unexpected overlap: %v", err)
+		}
+	}
+}
+
+// TestRoutesOption tests the routes driver option is parsed and handed to the endpoints
+func TestRoutesOption(t *testing.T) {
+	config := &configuration{
+		IpvlanMode:  modeL2,
+		Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "192.168.1.0/24", GwIP: "192.168.1.1/24"}},
+	}
+	err := config.fromOptions(map[string]string{routesOpt: "10.0.0.0/8 via 192.168.1.254, 172.16.0.0/12,2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("failed to parse routes: %v", err)
+	}
+	if err := config.validateRoutes(); err != nil {
+		t.Fatalf("unexpected invalid routes: %v", err)
+	}
+	for _, value := range []string{"10.0.0.0", "10.0.0.0/8 via", "10.0.0.0/8 through 192.168.1.254", "10.0.0.0/8 via 2001:db8::1"} {
+		if err := (&configuration{}).fromOptions(map[string]string{routesOpt: value}); err == nil {
+			t.Fatalf("invalid routes %q should have returned an error", value)
+		}
+	}
+	offLink := &configuration{IpvlanMode: modeL2, Ipv4Subnets: config.Ipv4Subnets}
+	if err := offLink.fromOptions(map[string]string{routesOpt: "10.0.0.0/8 via 192.168.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := offLink.validateRoutes(); err == nil {
+		t.Fatal("expected an error for a next hop outside of the network subnets")
+	}
+
+	n := &network{driver: &driver{leases: map[string]*dhcpLease{}}, config: config}
+	ep := &endpoint{id: testEndpointID}
+	if ep.addr, err = types.ParseCIDR("192.168.1.2/24"); err != nil {
+		t.Fatal(err)
+	}
+	res := &api.JoinResponse{}
+	if err := n.setJoinInfo(ep, res); err != nil {
+		t.Fatal(err)
+	}
+	// the v6 route is skipped for an endpoint without a v6 address
+	expected := []api.StaticRoute{
+		{Destination: "10.0.0.0/8", RouteType: types.NEXTHOP, NextHop: "192.168.1.254"},
+		{Destination: "172.16.0.0/12", RouteType: types.CONNECTED},
+	}
+	if res.Gateway != "192.168.1.1" || !reflect.DeepEqual(res.StaticRoutes, expected) {
+		t.Fatalf("unexpected join info: gateway %q, routes %v", res.Gateway, res.StaticRoutes)
+	}
+}
+
+// TestSubnetsDisjoint tests overlapping subnets within a network are rejected
+func TestSubnetsDisjoint(t *testing.T) {
+	config := &configuration{
+		Ipv4Subnets: []*ipv4Subnet{{SubnetIP: "10.1.0.0/24"}, {SubnetIP: "10.2.0.0/24"}},
+		Ipv6Subnets: []*ipv6Subnet{{SubnetIP: "2001:db8:1::/64"}, {SubnetIP: "2001:db8:2::/64"}},
+	}
+	if err := config.checkSubnetsDisjoint(); err != nil {
+		t.Fatalf("unexpected overlap: %v", err)
+	}
+	config.Ipv4Subnets = append(config.Ipv4Subnets, &ipv4Subnet{SubnetIP: "10.0.0.0/8"})
+	if err := config.checkSubnetsDisjoint(); err == nil {
+		t.Fatal("expected 10.0.0.0/8 to overlap with the other subnets of the network")
+	}
+}
+
+// TestDNSOptions tests the resolver options are persisted and reported by EndpointOperInfo
+func TestDNSOptions(t *testing.T) {
+	config := &configuration{ID: testNetworkID, IpvlanMode: modeL2}
+	err := config.fromOptions(map[string]string{
+		dnsOpt:        "10.0.0.53, 2001:db8::53",
+		dnsSearchOpt:  "example.com.,corp.example.com",
+		dnsOptionsOpt: "ndots:2,rotate",
+	})
+	if err != nil {
+		t.Fatalf("failed to parse the dns options: %v", err)
+	}
+	b, err := config.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &configuration{}
+	if err := restored.UnmarshalJSON(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.DNS, []string{"10.0.0.53", "2001:db8::53"}) ||
+		!reflect.DeepEqual(restored.DNSSearch, []string{"example.com", "corp.example.com"}) ||
+		!reflect.DeepEqual(restored.DNSOptions, []string{"ndots:2", "rotate"}) {
+		t.Fatalf("unexpected restored dns settings %v %v %v", restored.DNS, restored.DNSSearch, restored.DNSOptions)
+	}
+	invalid := []map[string]string{
+		{dnsOpt: "10.0.0.300"},
+		{dnsOpt: "10.0.0.1,10.0.0.2,10.0.0.3,10.0.0.4"},
+		{dnsSearchOpt: "example..com"},
+		{dnsOptionsOpt: "ndots 2"},
+	}
+	for _, options := range invalid {
+		if err := (&configuration{}).fromOptions(options); err == nil {
+			t.Fatalf("invalid dns options %v should have returned an error", options)
+		}
+	}
+
+	d := &driver{networks: networkTable{}, leases: map[string]*dhcpLease{}}
+	n := &network{id: testNetworkID, driver: d, config: restored, endpoints: endpointTable{}}
+	d.addNetwork(n)
+	n.addEndpoint(&endpoint{id: testEndpointID, nid: testNetworkID})
+	res, err := d.EndpointOperInfo(&api.EndpointInfoRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	if err != nil {
+		t.Fatalf("failed to get the endpoint info: %v", err)
+	}
+	if !reflect.DeepEqual(res.Value["DNSServers"], restored.DNS) || !reflect.DeepEqual(res.Value["DNSSearch"], restored.DNSSearch) ||
+		!reflect.DeepEqual(res.Value["DNSOptions"], restored.DNSOptions) {
+		t.Fatalf("unexpected dns settings in the endpoint info %v", res.Value)
+	}
+}
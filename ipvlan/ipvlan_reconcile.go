@@ -0,0 +1,66 @@
+package ipvlan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/ns"
+)
+
+// reconcileLinks is invoked at driver init once networks and endpoints have been
+// restored to delete the ipvlan slave links leaked by a previous plugin instance and
+// reinstall the routes of the restored endpoints
+func (d *driver) reconcileLinks() error {
+	deleted, err := d.deleteOrphanLinks()
+	if err != nil {
+		return err
+	}
+	for _, name := range deleted {
+		logrus.Infof("Deleted orphaned %s link %s", ipvlanType, name)
+	}
+	d.restoreEndpointRoutes()
+
+	return nil
+}
+
+// deleteOrphanLinks removes host ipvlan links named by the driver and attached to one of
+// the driver's parents that are no longer bound to an endpoint, returning their names
+func (d *driver) deleteOrphanLinks() ([]string, error) {
+	parents := make(map[int]bool)
+	inUse := make(map[string]bool)
+	for _, n := range d.getNetworks() {
+		if link, err := ns.NlHandle().LinkByName(n.config.Parent); err == nil {
+			parents[link.Attrs().Index] = true
+		}
+		n.Lock()
+		for _, ep := range n.endpoints {
+			if ep.srcName != "" {
+				inUse[ep.srcName] = true
+			}
+		}
+		n.Unlock()
+	}
+	links, err := ns.NlHandle().LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host links: %v", err)
+	}
+	var deleted []string
+	for _, link := range links {
+		name := link.Attrs().Name
+		// only consider slaves created by this driver, other drivers use the same naming
+		if link.Type() != ipvlanType || !strings.HasPrefix(name, vethPrefix) {
+			continue
+		}
+		if !parents[link.Attrs().ParentIndex] || inUse[name] {
+			continue
+		}
+		if err := ns.NlHandle().LinkDel(link); err != nil {
+			logrus.Warnf("Failed to delete orphaned %s link %s: %v", ipvlanType, name, err)
+			continue
+		}
+		deleted = append(deleted, name)
+	}
+
+	return deleted, nil
+}
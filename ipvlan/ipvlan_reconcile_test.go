@@ -0,0 +1,137 @@
+package ipvlan
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+// TestDeleteOrphanLinks tests only unbound slaves of the driver's parents are deleted
+func TestDeleteOrphanLinks(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	d, err := NewDriver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "192.168.20.0/24", nil)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.20.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	n := d.network(testNetworkID)
+	bound, err := createIPVlan("veth0000001", n.config.Parent, n.config.IpvlanMode, n.config.IpvlanFlag, n.config.Mtu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.endpoint(testEndpointID).srcName = bound
+	orphan, err := createIPVlan("veth0000002", n.config.Parent, n.config.IpvlanMode, n.config.IpvlanFlag, n.config.Mtu)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := d.deleteOrphanLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != orphan {
+		t.Fatalf("expected only %s to be deleted, got %v", orphan, deleted)
+	}
+	if !parentExists(bound) {
+		t.Fatalf("link %s bound to an endpoint was deleted", bound)
+	}
+	if parentExists(orphan) {
+		t.Fatalf("orphaned link %s was not deleted", orphan)
+	}
+}
+
+// TestPopulateNetworks tests only networks whose parent can not be rebuilt are purged on
+// restore, networks failing to restore for other reasons keep their records
+func TestPopulateNetworks(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	dir, err := ioutil.TempDir("", "ipvlan-populate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"dm-lost", "dm-kept"} {
+		if err := ns.NlHandle().LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: 1500}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lost, kept, owned := stringid.GenerateRandomID(), stringid.GenerateRandomID(), stringid.GenerateRandomID()
+	d := newTestDriver(t, dir)
+	if err := d.CreateNetwork(newTestNetworkRequest(t, lost, "192.168.40.0/24", map[string]interface{}{parentOpt: "dm-lost"})); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, kept, "192.168.41.0/24", map[string]interface{}{parentOpt: "dm-kept", mtuOpt: "1400"})); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, owned, "192.168.42.0/24", nil)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  kept,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.41.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	d.Close()
+
+	// the user parent is gone, the mtu no longer fits the other user parent and the
+	// driver created parent is gone but can be recreated
+	for _, name := range []string{"dm-lost", getDummyName(stringid.TruncateID(owned))} {
+		link, err := ns.NlHandle().LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ns.NlHandle().LinkDel(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link, err := ns.NlHandle().LinkByName("dm-kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.NlHandle().LinkSetMTU(link, 1300); err != nil {
+		t.Fatal(err)
+	}
+
+	d = newTestDriver(t, dir)
+	defer d.Close()
+	if _, ok := d.networks[owned]; !ok {
+		t.Fatal("the network with a recreated driver parent was not restored")
+	}
+	if !parentExists(getDummyName(stringid.TruncateID(owned))) {
+		t.Fatal("the driver parent link was not recreated")
+	}
+	if _, ok := d.networks[kept]; ok {
+		t.Fatal("expected the network with an invalid mtu not to be restored")
+	}
+	if err := d.store.GetObject(datastore.Key(ipvlanNetworkPrefix, kept), &configuration{}); err != nil {
+		t.Fatalf("expected the record of the unrestored network to be kept: %v", err)
+	}
+	if err := d.store.GetObject(datastore.Key(ipvlanEndpointPrefix, testEndpointID), &endpoint{}); err != nil {
+		t.Fatalf("expected the endpoint of the unrestored network to be kept: %v", err)
+	}
+	if err := d.store.GetObject(datastore.Key(ipvlanNetworkPrefix, lost), &configuration{}); err != datastore.ErrKeyNotFound {
+		t.Fatalf("expected the network with a lost parent to be purged, got %v", err)
+	}
+}
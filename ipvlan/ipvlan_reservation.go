@@ -0,0 +1,262 @@
+package ipvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/docker/libnetwork/types"
+)
+
+const (
+	reservationOpt          = "reservation" // pins the endpoint addresses --driver-opt reservation=<name>
+	ipvlanReservationPrefix = ipvlanPrefix + "/reservation"
+	maxReservationLen       = 64
+)
+
+// reservation pins the addresses of the endpoints created under the same name on a network,
+// e.g. a container recreated with --network name=<net>,driver-opt=reservation=<name>. The
+// addresses are recorded by the first endpoint and kept once the endpoint is deleted. Only
+// the ipam of this plugin keeps an unused reserved address from other containers, docker's
+// default ipam would hand it out, so reservations require the plugin ipam or dhcp
+type reservation struct {
+	Name        string
+	Nid         string
+	Address     string
+	AddressIPv6 string
+	Eid         string // endpoint holding the reservation, empty while unused
+	dbIndex     uint64
+	dbExists    bool
+}
+
+// macAddressError explains why the endpoints can not be given a mac address. Every ipvlan
+// slave shares the mac address of the parent link, whatever the mode
+func macAddressError(config *configuration) error {
+	var reason string
+	switch config.IpvlanMode {
+	case modeL2:
+		reason = fmt.Sprintf("in %s mode the endpoints answer arp and neighbour discovery with the mac address of parent %s", modeL2, config.Parent)
+	default:
+		reason = fmt.Sprintf("in %s mode parent %s routes the traffic of the endpoints, no endpoint mac address is seen on the wire", config.IpvlanMode, config.Parent)
+	}
+
+	return types.BadRequestErrorf("%s interfaces do not support custom mac address assignment: %s. Pin the endpoint addresses with the %q endpoint option instead",
+		ipvlanType, reason, reservationOpt)
+}
+
+// reservationName reads the reservation requested with the endpoint options
+func reservationName(options map[string]interface{}) (string, error) {
+	v, ok := options[reservationOpt]
+	if !ok {
+		return "", nil
+	}
+	name, ok := v.(string)
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || len(name) > maxReservationLen || strings.ContainsAny(name, "/ \t") {
+		return "", types.BadRequestErrorf("invalid reservation name %v", v)
+	}
+
+	return name, nil
+}
+
+func reservationKey(nid, name string) string {
+	return nid + "/" + name
+}
+
+// pin checks the addresses of the endpoint match the reservation, addresses of a family
+// the reservation does not hold yet are recorded
+func (res *reservation) pin(ep *endpoint) error {
+	check := func(reserved *string, addr *net.IPNet) error {
+		switch {
+		case *reserved == "":
+			if addr != nil {
+				*reserved = addr.IP.String()
+			}
+		case addr == nil || addr.IP.String() != *reserved:
+			return types.ForbiddenErrorf("reservation %q pins address %s, create the endpoint with --ip %s", res.Name, *reserved, *reserved)
+		}
+		return nil
+	}
+	if err := check(&res.Address, ep.addr); err != nil {
+		return err
+	}
+	return check(&res.AddressIPv6, ep.addrv6)
+}
+
+// claimReservation binds the endpoint to its reservation, the reservation is created by the
+// first endpoint requesting it
+func (d *driver) claimReservation(n *network, ep *endpoint) error {
+	d.resMu.Lock()
+	defer d.resMu.Unlock()
+
+	key := reservationKey(n.id, ep.reservation)
+	res, ok := d.reservations[key]
+	if !ok && !n.config.DriverIpam && !n.config.Dhcp {
+		return types.BadRequestErrorf("reservation %q requires the %s ipam driver or -o %s=true, other ipam drivers do not keep the reserved address from other containers",
+			ep.reservation, ipvlanType, dhcpOpt)
+	}
+	if ok && res.Eid != "" && res.Eid != ep.id && n.endpoint(res.Eid) != nil {
+		return types.ForbiddenErrorf("reservation %q is held by endpoint %s", ep.reservation, res.Eid[0:7])
+	}
+	next := &reservation{Name: ep.reservation, Nid: n.id}
+	if ok {
+		*next = *res
+	}
+	if err := next.pin(ep); err != nil {
+		return err
+	}
+	next.Eid = ep.id
+	if err := d.storeUpdate(next); err != nil {
+		return fmt.Errorf("failed to save reservation %q to store: %v", ep.reservation, err)
+	}
+	d.reservations[key] = next
+	logrus.Debugf("Endpoint %s holds reservation %q of %s %s", ep.id[0:7], next.Name, next.Address, next.AddressIPv6)
+
+	return nil
+}
+
+// unclaimReservation keeps the addresses of the endpoint reserved once it is deleted
+func (d *driver) unclaimReservation(ep *endpoint) {
+	if ep.reservation == "" {
+		return
+	}
+	d.resMu.Lock()
+	defer d.resMu.Unlock()
+
+	res, ok := d.reservations[reservationKey(ep.nid, ep.reservation)]
+	if !ok || res.Eid != ep.id {
+		return
+	}
+	res.Eid = ""
+	if err := d.storeUpdate(res); err != nil {
+		logrus.Warnf("Failed to save reservation %q to store: %v", res.Name, err)
+	}
+}
+
+// deleteReservations deletes the reservations of a deleted network
+func (d *driver) deleteReservations(nid string) {
+	d.resMu.Lock()
+	defer d.resMu.Unlock()
+
+	for key, res := range d.reservations {
+		if res.Nid != nid {
+			continue
+		}
+		delete(d.reservations, key)
+		if err := d.storeDelete(res); err != nil {
+			logrus.Warnf("Failed to remove reservation %q from store: %v", res.Name, err)
+		}
+	}
+}
+
+// pinnedAddresses returns the reserved addresses of the networks allocating from the pool,
+// they are only handed out by the ipam when requested explicitly
+func (d *driver) pinnedAddresses(pool string) map[string]bool {
+	inPool := map[string]bool{}
+	for _, n := range d.getNetworks() {
+		for _, s := range n.config.subnets() {
+			if s == pool {
+				inPool[n.id] = true
+			}
+		}
+	}
+
+	d.resMu.Lock()
+	defer d.resMu.Unlock()
+
+	pinned := map[string]bool{}
+	for _, res := range d.reservations {
+		if !inPool[res.Nid] {
+			continue
+		}
+		if res.Address != "" {
+			pinned[res.Address] = true
+		}
+		if res.AddressIPv6 != "" {
+			pinned[res.AddressIPv6] = true
+		}
+	}
+	return pinned
+}
+
+// populateReservations restores the reservations of the restored networks
+func (d *driver) populateReservations() error {
+	kvol, err := d.store.List(datastore.Key(ipvlanReservationPrefix), &reservation{})
+	if err != nil && err != datastore.ErrKeyNotFound {
+		storeErrors.WithLabelValues("list").Inc()
+		return fmt.Errorf("failed to get ipvlan reservations from store: %v", err)
+	}
+	if err == datastore.ErrKeyNotFound {
+		return nil
+	}
+	for _, kvo := range kvol {
+		res := kvo.(*reservation)
+		if d.unrestored[res.Nid] {
+			continue
+		}
+		if _, ok := d.networks[res.Nid]; !ok {
+			logrus.Debugf("Deleting the stale reservation %q of network (%s) from store", res.Name, res.Nid[0:7])
+			if err := d.storeDelete(res); err != nil {
+				logrus.Debugf("Failed to delete the stale reservation %q from store: %v", res.Name, err)
+			}
+			continue
+		}
+		d.reservations[reservationKey(res.Nid, res.Name)] = res
+	}
+
+	return nil
+}
+
+func (res *reservation) Key() []string {
+	return []string{ipvlanReservationPrefix, res.Nid, res.Name}
+}
+
+func (res *reservation) KeyPrefix() []string {
+	return []string{ipvlanReservationPrefix}
+}
+
+func (res *reservation) Value() []byte {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (res *reservation) SetValue(value []byte) error {
+	return json.Unmarshal(value, res)
+}
+
+func (res *reservation) Index() uint64 {
+	return res.dbIndex
+}
+
+func (res *reservation) SetIndex(index uint64) {
+	res.dbIndex = index
+	res.dbExists = true
+}
+
+func (res *reservation) Exists() bool {
+	return res.dbExists
+}
+
+func (res *reservation) Skip() bool {
+	return false
+}
+
+func (res *reservation) New() datastore.KVObject {
+	return &reservation{}
+}
+
+func (res *reservation) CopyTo(o datastore.KVObject) error {
+	dst := o.(*reservation)
+	*dst = *res
+	return nil
+}
+
+func (res *reservation) DataScope() string {
+	return datastore.LocalScope
+}
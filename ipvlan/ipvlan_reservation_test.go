@@ -0,0 +1,111 @@
+package ipvlan
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/testutils"
+	"github.com/docker/libnetwork/types"
+)
+
+func createReservedEndpoint(d *driver, eid, address string) error {
+	_, err := d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: eid,
+		Interface:  &api.EndpointInterface{Address: address},
+		Options:    map[string]interface{}{reservationOpt: "web"},
+	})
+	return err
+}
+
+// TestReservation tests a reservation of a network allocated by the plugin ipam pins the
+// endpoint address across endpoint recreation and driver restarts
+func TestReservation(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	dir, err := ioutil.TempDir("", "ipvlan-reservation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newTestDriver(t, dir)
+	// docker's default ipam would hand the reserved address to other containers
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "192.168.80.0/24", nil)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	err = createReservedEndpoint(d, testEndpointID, "192.168.80.2/24")
+	if _, ok := err.(types.BadRequestError); !ok {
+		t.Fatalf("expected a bad request error for a reservation without the plugin ipam, got %v", err)
+	}
+	if err := d.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: testNetworkID}); err != nil {
+		t.Fatalf("failed to delete network: %v", err)
+	}
+	req := newTestNetworkRequest(t, testNetworkID, "192.168.80.0/24", nil)
+	req.IPv4Data[0].AddressSpace = localAddressSpace
+	if err := d.CreateNetwork(req); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.80.2/24", MacAddress: "02:42:c0:a8:50:02"},
+	})
+	if _, ok := err.(types.BadRequestError); !ok {
+		t.Fatalf("expected a bad request error for a custom mac address, got %v", err)
+	}
+
+	if err := createReservedEndpoint(d, testEndpointID, "192.168.80.2/24"); err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	if err := createReservedEndpoint(d, testEndpointID2, "192.168.80.3/24"); err == nil {
+		t.Fatal("expected an error for a reservation held by another endpoint")
+	}
+	if err := d.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+		t.Fatalf("failed to delete endpoint: %v", err)
+	}
+
+	// the reservation survives the endpoint and a driver restart
+	d = newTestDriver(t, dir)
+	if !d.pinnedAddresses("192.168.80.0/24")["192.168.80.2"] {
+		t.Fatal("the reserved address was not restored from the store")
+	}
+	// the reservation does not pin the address in the pools of other networks
+	other := stringid.GenerateRandomID()
+	if err := d.CreateNetwork(newTestNetworkRequest(t, other, "192.168.80.0/25", nil)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	if d.pinnedAddresses("192.168.80.0/25")["192.168.80.2"] {
+		t.Fatal("the reserved address is pinned in the overlapping pool of another network")
+	}
+	if err := d.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: other}); err != nil {
+		t.Fatalf("failed to delete network: %v", err)
+	}
+	err = createReservedEndpoint(d, testEndpointID2, "192.168.80.3/24")
+	if _, ok := err.(types.ForbiddenError); !ok {
+		t.Fatalf("expected a forbidden error for an address other than the reserved one, got %v", err)
+	}
+	if err := createReservedEndpoint(d, testEndpointID2, "192.168.80.2/24"); err != nil {
+		t.Fatalf("failed to recreate the endpoint with the reserved address: %v", err)
+	}
+	res, err := d.EndpointOperInfo(&api.EndpointInfoRequest{NetworkID: testNetworkID, EndpointID: testEndpointID2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value["Reservation"] != "web" {
+		t.Fatalf("expected the reservation in the endpoint info, got %v", res.Value)
+	}
+
+	if err := d.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID2}); err != nil {
+		t.Fatalf("failed to delete endpoint: %v", err)
+	}
+	if err := d.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: testNetworkID}); err != nil {
+		t.Fatalf("failed to delete network: %v", err)
+	}
+	if len(d.reservations) != 0 {
+		t.Fatal("the reservations were not deleted with the network")
+	}
+}
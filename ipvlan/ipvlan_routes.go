@@ -0,0 +1,137 @@
+package ipvlan
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
+	"github.com/vishvananda/netlink"
+)
+
+const hostRouteProto = 73 // protocol of the endpoint host routes, unassigned in /etc/iproute2/rt_protos
+
+// routeAnnouncer exports the prefixes of the l3 and l3s endpoints beyond the host,
+// e.g. to the top of rack switches, instead of hand maintained static routes
+type routeAnnouncer interface {
+	Announce(prefix *net.IPNet) error
+	Withdraw(prefix *net.IPNet) error
+	Close() error
+}
+
+// routed checks the endpoints of the network are reached by routing instead of bridging
+func (config *configuration) routed() bool {
+	return config.IpvlanMode == modeL3 || config.IpvlanMode == modeL3S
+}
+
+// hostPrefix returns the host prefix of an endpoint address
+func hostPrefix(addr *net.IPNet) *net.IPNet {
+	if ip := addr.IP.To4(); ip != nil {
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(128, 128)}
+}
+
+// addrs returns the addresses of the endpoint
+func (ep *endpoint) addrs() []*net.IPNet {
+	var addrs []*net.IPNet
+	if ep.addr != nil {
+		addrs = append(addrs, ep.addr)
+	}
+	if ep.addrv6 != nil {
+		addrs = append(addrs, ep.addrv6)
+	}
+	return addrs
+}
+
+// hostRoutes returns the host routes of the endpoint addresses. The host access link
+// carries the v4 route when present, otherwise l3 and l3s routes go through the parent
+func (n *network) hostRoutes(ep *endpoint) ([]*netlink.Route, error) {
+	var routes []*netlink.Route
+	for _, addr := range ep.addrs() {
+		var name string
+		switch {
+		case n.config.HostAccess && addr.IP.To4() != nil:
+			name = getShimName(stringid.TruncateID(n.config.ID))
+		case n.config.routed():
+			name = n.config.Parent
+		default:
+			continue
+		}
+		link, err := ns.NlHandle().LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find link %s routing endpoint %s: %v", name, ep.id[0:7], err)
+		}
+		routes = append(routes, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       hostPrefix(addr),
+			Protocol:  hostRouteProto,
+		})
+	}
+
+	return routes, nil
+}
+
+// addEndpointRoutes installs the host routes of the endpoint and announces the
+// prefixes of l3 and l3s endpoints
+func (n *network) addEndpointRoutes(ep *endpoint) error {
+	routes, err := n.hostRoutes(ep)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := ns.NlHandle().RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add the host route to %s: %v", route.Dst, err)
+		}
+	}
+	if a := n.driver.announcer; a != nil && n.config.routed() {
+		for _, addr := range ep.addrs() {
+			err := a.Announce(hostPrefix(addr))
+			if _, ok := err.(types.NotImplementedError); ok {
+				// reported once per network at create
+				logrus.Debugf("The prefix of endpoint %s is not exported: %v", ep.id[0:7], err)
+			} else if err != nil {
+				logrus.Warnf("Failed to announce the prefix of endpoint %s: %v", ep.id[0:7], err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// delEndpointRoutes withdraws the prefixes and deletes the host routes of the endpoint
+func (n *network) delEndpointRoutes(ep *endpoint) {
+	if a := n.driver.announcer; a != nil && n.config.routed() {
+		for _, addr := range ep.addrs() {
+			if err := a.Withdraw(hostPrefix(addr)); err != nil {
+				logrus.Warnf("Failed to withdraw the prefix of endpoint %s: %v", ep.id[0:7], err)
+			}
+		}
+	}
+	routes, err := n.hostRoutes(ep)
+	if err != nil {
+		logrus.Debugf("Failed to resolve the host routes of endpoint %s: %v", ep.id[0:7], err)
+		return
+	}
+	for _, route := range routes {
+		if err := ns.NlHandle().RouteDel(route); err != nil {
+			logrus.Debugf("Failed to delete the host route to %s: %v", route.Dst, err)
+		}
+	}
+}
+
+// restoreEndpointRoutes reinstalls and announces the routes of the restored endpoints
+func (d *driver) restoreEndpointRoutes() {
+	for _, n := range d.getNetworks() {
+		n.Lock()
+		for _, ep := range n.endpoints {
+			if err := n.addEndpointRoutes(ep); err != nil {
+				logrus.Warnf("Failed to restore the host routes of endpoint %s: %v", ep.id[0:7], err)
+			}
+		}
+		n.Unlock()
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"strings"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/parsers/kernel"
 	"github.com/docker/libnetwork/ns"
+	"github.com/docker/libnetwork/types"
 	"github.com/vishvananda/netlink"
 )
 
@@ -14,22 +16,33 @@ const (
 	dummyPrefix     = "di-" // ipvlan prefix for dummy parent interface
 	ipvlanKernelVer = 4     // minimum ipvlan kernel support
 	ipvlanMajorVer  = 2     // minimum ipvlan major kernel support
+	l3sKernelVer    = 4     // minimum ipvlan l3s mode kernel support
+	l3sMajorVer     = 9     // minimum ipvlan l3s mode major kernel support
+	flagKernelVer   = 4     // minimum ipvlan private and vepa flag kernel support
+	flagMajorVer    = 15    // minimum ipvlan private and vepa flag major kernel support
+	minMtu          = 68    // minimum mtu of a link carrying ipv4
 )
 
 // createIPVlan Create the ipvlan slave specifying the source name
-func createIPVlan(containerIfName, parent, ipvlanMode string) (string, error) {
+func createIPVlan(containerIfName, parent, ipvlanMode, ipvlanFlag string, mtu int) (string, error) {
 	// Set the ipvlan mode. Default is bridge mode
 	mode, err := setIPVlanMode(ipvlanMode)
 	if err != nil {
-		return "", fmt.Errorf("Unsupported %s ipvlan mode: %v", ipvlanMode, err)
+		return "", types.BadRequestErrorf("Unsupported %s ipvlan mode: %v", ipvlanMode, err)
+	}
+	// Set the ipvlan flag. Default is bridge flag
+	flag, err := setIPVlanFlag(ipvlanFlag)
+	if err != nil {
+		return "", types.BadRequestErrorf("Unsupported %s ipvlan flag: %v", ipvlanFlag, err)
 	}
 	// verify the Docker host interface acting as the macvlan parent iface exists
 	if !parentExists(parent) {
-		return "", fmt.Errorf("the requested parent interface %s was not found on the Docker host", parent)
+		return "", types.NotFoundErrorf("the requested parent interface %s was not found on the Docker host", parent)
 	}
 	// Get the link for the master index (Example: the docker host eth iface)
 	parentLink, err := ns.NlHandle().LinkByName(parent)
 	if err != nil {
+		netlinkFailures.WithLabelValues("create_ipvlan").Inc()
 		return "", fmt.Errorf("error occoured looking up the %s parent iface %s error: %s", ipvlanType, parent, err)
 	}
 	// Create an ipvlan link
@@ -37,30 +50,66 @@ func createIPVlan(containerIfName, parent, ipvlanMode string) (string, error) {
 		LinkAttrs: netlink.LinkAttrs{
 			Name:        containerIfName,
 			ParentIndex: parentLink.Attrs().Index,
-			// TODO: MTU  see: com.docker.network.driver.mtu
+			MTU:         mtu,
 		},
 		Mode: mode,
+		Flag: flag,
 	}
 	if err := ns.NlHandle().LinkAdd(ipvlan); err != nil {
 		// If a user creates a macvlan and ipvlan on same parent, only one slave iface can be active at a time.
-		return "", fmt.Errorf("failed to create the %s port: %v", ipvlanType, err)
+		netlinkFailures.WithLabelValues("create_ipvlan").Inc()
+		return "", types.InternalErrorf("failed to create the %s port: %v", ipvlanType, err)
 	}
 
 	return ipvlan.Attrs().Name, nil
 }
 
-// setIPVlanMode setter for one of the two ipvlan port types
+// isIPVlanSlave checks if the link is an ipvlan slave of the parent interface
+func isIPVlanSlave(link netlink.Link, parent string) bool {
+	if link.Type() != ipvlanType {
+		return false
+	}
+	parentLink, err := ns.NlHandle().LinkByName(parent)
+	if err != nil {
+		return false
+	}
+
+	return link.Attrs().ParentIndex == parentLink.Attrs().Index
+}
+
+// setIPVlanMode setter for one of the three ipvlan port types
 func setIPVlanMode(mode string) (netlink.IPVlanMode, error) {
 	switch mode {
 	case modeL2:
 		return netlink.IPVLAN_MODE_L2, nil
 	case modeL3:
 		return netlink.IPVLAN_MODE_L3, nil
+	case modeL3S:
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, types.BadRequestErrorf("Unknown ipvlan mode: %s", mode)
+	}
+}
+
+// setIPVlanFlag setter for one of the three ipvlan port flags, an empty flag is bridge
+func setIPVlanFlag(flag string) (netlink.IPVlanFlag, error) {
+	switch flag {
+	case "", flagBridge:
+		return netlink.IPVLAN_FLAG_BRIDGE, nil
+	case flagPrivate:
+		return netlink.IPVLAN_FLAG_PRIVATE, nil
+	case flagVepa:
+		return netlink.IPVLAN_FLAG_VEPA, nil
 	default:
-		return 0, fmt.Errorf("Unknown ipvlan mode: %s", mode)
+		return 0, types.BadRequestErrorf("Unknown ipvlan flag: %s", flag)
 	}
 }
 
+// kernelAtLeast checks the running kernel version is at least kernelVer.majorVer
+func kernelAtLeast(kv *kernel.VersionInfo, kernelVer, majorVer int) bool {
+	return kv.Kernel > kernelVer || (kv.Kernel == kernelVer && kv.Major >= majorVer)
+}
+
 // parentExists check if the specified interface exists in the default namespace
 func parentExists(ifaceStr string) bool {
 	_, err := ns.NlHandle().LinkByName(ifaceStr)
@@ -71,8 +120,22 @@ func parentExists(ifaceStr string) bool {
 	return true
 }
 
+// validateParentMtu verifies the parent link can carry frames of the requested mtu
+func validateParentMtu(parent string, mtu int) error {
+	parentLink, err := ns.NlHandle().LinkByName(parent)
+	if err != nil {
+		return types.NotFoundErrorf("error occoured looking up the %s parent iface %s error: %s", ipvlanType, parent, err)
+	}
+	if mtu > parentLink.Attrs().MTU {
+		return types.BadRequestErrorf("requested mtu %d exceeds the mtu %d of the %s parent interface %s",
+			mtu, parentLink.Attrs().MTU, ipvlanType, parent)
+	}
+
+	return nil
+}
+
 // createVlanLink parses sub-interfaces and vlan id for creation
-func createVlanLink(parentName string) error {
+func createVlanLink(parentName string, mtu int) error {
 	if strings.Contains(parentName, ".") {
 		parent, vidInt, err := parseVlan(parentName)
 		if err != nil {
@@ -80,33 +143,40 @@ func createVlanLink(parentName string) error {
 		}
 		// VLAN identifier or VID is a 12-bit field specifying the VLAN to which the frame belongs
 		if vidInt > 4094 || vidInt < 1 {
-			return fmt.Errorf("vlan id must be between 1-4094, received: %d", vidInt)
+			return types.BadRequestErrorf("vlan id must be between 1-4094, received: %d", vidInt)
 		}
 		// get the parent link to attach a vlan subinterface
 		parentLink, err := ns.NlHandle().LinkByName(parent)
 		if err != nil {
-			return fmt.Errorf("failed to find master interface %s on the Docker host: %v", parent, err)
+			return types.NotFoundErrorf("failed to find master interface %s on the Docker host: %v", parent, err)
+		}
+		// a vlan subinterface can not carry frames larger than its master
+		if mtu > parentLink.Attrs().MTU {
+			return types.BadRequestErrorf("requested mtu %d exceeds the mtu %d of the master interface %s", mtu, parentLink.Attrs().MTU, parent)
 		}
 		vlanLink := &netlink.Vlan{
 			LinkAttrs: netlink.LinkAttrs{
 				Name:        parentName,
 				ParentIndex: parentLink.Attrs().Index,
+				MTU:         mtu,
 			},
 			VlanId: vidInt,
 		}
 		// create the subinterface
 		if err := ns.NlHandle().LinkAdd(vlanLink); err != nil {
-			return fmt.Errorf("failed to create %s vlan link: %v", vlanLink.Name, err)
+			netlinkFailures.WithLabelValues("create_vlan_link").Inc()
+			return types.InternalErrorf("failed to create %s vlan link: %v", vlanLink.Name, err)
 		}
 		// Bring the new netlink iface up
 		if err := ns.NlHandle().LinkSetUp(vlanLink); err != nil {
-			return fmt.Errorf("failed to enable %s the ipvlan parent link %v", vlanLink.Name, err)
+			netlinkFailures.WithLabelValues("create_vlan_link").Inc()
+			return types.InternalErrorf("failed to enable %s the ipvlan parent link %v", vlanLink.Name, err)
 		}
 		logrus.Debugf("Added a vlan tagged netlink subinterface: %s with a vlan id: %d", parentName, vidInt)
 		return nil
 	}
 
-	return fmt.Errorf("invalid subinterface vlan name %s, example formatting is eth0.10", parentName)
+	return types.BadRequestErrorf("invalid subinterface vlan name %s, example formatting is eth0.10", parentName)
 }
 
 // delVlanLink verifies only sub-interfaces with a vlan id get deleted
@@ -141,39 +211,43 @@ func parseVlan(linkName string) (string, int, error) {
 	// parse -o parent=eth0.10
 	splitName := strings.Split(linkName, ".")
 	if len(splitName) != 2 {
-		return "", 0, fmt.Errorf("required interface name format is: name.vlan_id, ex. eth0.10 for vlan 10, instead received %s", linkName)
+		return "", 0, types.BadRequestErrorf("required interface name format is: name.vlan_id, ex. eth0.10 for vlan 10, instead received %s", linkName)
 	}
 	parent, vidStr := splitName[0], splitName[1]
 	// validate type and convert vlan id to int
 	vidInt, err := strconv.Atoi(vidStr)
 	if err != nil {
-		return "", 0, fmt.Errorf("unable to parse a valid vlan id from: %s (ex. eth0.10 for vlan 10)", vidStr)
+		return "", 0, types.BadRequestErrorf("unable to parse a valid vlan id from: %s (ex. eth0.10 for vlan 10)", vidStr)
 	}
 	// Check if the interface exists
 	if !parentExists(parent) {
-		return "", 0, fmt.Errorf("-o parent interface does was not found on the host: %s", parent)
+		return "", 0, types.NotFoundErrorf("-o parent interface does was not found on the host: %s", parent)
 	}
 
 	return parent, vidInt, nil
 }
 
 // createDummyLink creates a dummy0 parent link
-func createDummyLink(dummyName, truncNetID string) error {
+func createDummyLink(dummyName, truncNetID string, mtu int) error {
 	// create a parent interface since one was not specified
 	parent := &netlink.Dummy{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: dummyName,
+			MTU:  mtu,
 		},
 	}
 	if err := ns.NlHandle().LinkAdd(parent); err != nil {
+		netlinkFailures.WithLabelValues("create_dummy_link").Inc()
 		return err
 	}
 	parentDummyLink, err := ns.NlHandle().LinkByName(dummyName)
 	if err != nil {
+		netlinkFailures.WithLabelValues("create_dummy_link").Inc()
 		return fmt.Errorf("error occoured looking up the %s parent iface %s error: %s", ipvlanType, dummyName, err)
 	}
 	// bring the new netlink iface up
 	if err := ns.NlHandle().LinkSetUp(parentDummyLink); err != nil {
+		netlinkFailures.WithLabelValues("create_dummy_link").Inc()
 		return fmt.Errorf("failed to enable %s the ipvlan parent link: %v", dummyName, err)
 	}
 
@@ -68,6 +68,14 @@ func TestSetIPVlanMode(t *testing.T) {
 	if mode != netlink.IPVLAN_MODE_L3 {
 		t.Fatalf("expected %d got %d", netlink.IPVLAN_MODE_L3, mode)
 	}
+	// test ipvlan l3s mode
+	mode, err = setIPVlanMode(modeL3S)
+	if err != nil {
+		t.Fatalf("error parsing %v vlan mode: %v", mode, err)
+	}
+	if mode != netlink.IPVLAN_MODE_L3S {
+		t.Fatalf("expected %d got %d", netlink.IPVLAN_MODE_L3S, mode)
+	}
 	// test invalid mode
 	mode, err = setIPVlanMode("foo")
 	if err == nil {
@@ -85,3 +93,26 @@ func TestSetIPVlanMode(t *testing.T) {
 		t.Fatalf("expected 0 got %d", mode)
 	}
 }
+
+// TestSetIPVlanFlag tests the ipvlan flag setter
+func TestSetIPVlanFlag(t *testing.T) {
+	flags := map[string]netlink.IPVlanFlag{
+		"":          netlink.IPVLAN_FLAG_BRIDGE,
+		flagBridge:  netlink.IPVLAN_FLAG_BRIDGE,
+		flagPrivate: netlink.IPVLAN_FLAG_PRIVATE,
+		flagVepa:    netlink.IPVLAN_FLAG_VEPA,
+	}
+	for name, expected := range flags {
+		flag, err := setIPVlanFlag(name)
+		if err != nil {
+			t.Fatalf("error parsing %q ipvlan flag: %v", name, err)
+		}
+		if flag != expected {
+			t.Fatalf("expected %d got %d", expected, flag)
+		}
+	}
+	// test invalid flag
+	if _, err := setIPVlanFlag("foo"); err == nil {
+		t.Fatal("invalid ipvlan flag should have returned an error")
+	}
+}
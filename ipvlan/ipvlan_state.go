@@ -1,8 +1,6 @@
 package ipvlan
 
 import (
-	"fmt"
-
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/libnetwork/osl"
 	"github.com/docker/libnetwork/types"
@@ -44,6 +42,21 @@ func (d *driver) getNetworks() []*network {
 	return ls
 }
 
+// parentRefs returns the number of networks other than nid using the parent link
+func (d *driver) parentRefs(parent, nid string) int {
+	d.Lock()
+	defer d.Unlock()
+
+	refs := 0
+	for id, nw := range d.networks {
+		if id != nid && nw.config.Parent == parent {
+			refs++
+		}
+	}
+
+	return refs
+}
+
 func (n *network) endpoint(eid string) *endpoint {
 	n.Lock()
 	defer n.Unlock()
@@ -67,7 +80,7 @@ func (n *network) getEndpoint(eid string) (*endpoint, error) {
 	n.Lock()
 	defer n.Unlock()
 	if eid == "" {
-		return nil, fmt.Errorf("endpoint id %s not found", eid)
+		return nil, types.BadRequestErrorf("invalid endpoint id")
 	}
 	if ep, ok := n.endpoints[eid]; ok {
 		return ep, nil
@@ -78,10 +91,10 @@ func (n *network) getEndpoint(eid string) (*endpoint, error) {
 
 func validateID(nid, eid string) error {
 	if nid == "" {
-		return fmt.Errorf("invalid network id")
+		return types.BadRequestErrorf("invalid network id")
 	}
 	if eid == "" {
-		return fmt.Errorf("invalid endpoint id")
+		return types.BadRequestErrorf("invalid endpoint id")
 	}
 
 	return nil
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/libkv/store"
 	"github.com/docker/libnetwork/datastore"
 	"github.com/docker/libnetwork/discoverapi"
 	"github.com/docker/libnetwork/netlabel"
@@ -16,6 +18,8 @@ const (
 	ipvlanPrefix         = "ipvlan"
 	ipvlanNetworkPrefix  = ipvlanPrefix + "/network"
 	ipvlanEndpointPrefix = ipvlanPrefix + "/endpoint"
+	storeBucket          = "ipvlan"
+	storeTimeout         = time.Minute
 )
 
 // networkConfiguration for this driver's network specific configuration
@@ -24,12 +28,22 @@ type configuration struct {
 	Mtu              int
 	dbIndex          uint64
 	dbExists         bool
+	scope            string
 	Internal         bool
 	Parent           string
 	IpvlanMode       string
+	IpvlanFlag       string
+	Dhcp             bool
+	DriverIpam       bool // the subnets are allocated by the ipam driver of this plugin
+	HostAccess       bool
+	HostAddress      string
 	CreatedSlaveLink bool
 	Ipv4Subnets      []*ipv4Subnet
 	Ipv6Subnets      []*ipv6Subnet
+	Routes           []*staticRoute
+	DNS              []string
+	DNSSearch        []string
+	DNSOptions       []string
 }
 
 type ipv4Subnet struct {
@@ -42,8 +56,27 @@ type ipv6Subnet struct {
 	GwIP     string
 }
 
+// staticRoute is a route handed to every endpoint of the network, connected without a next hop
+type staticRoute struct {
+	Destination string
+	NextHop     string
+}
+
 // initStore drivers are responsible for caching their own persistent state
 func (d *driver) initStore(option map[string]interface{}) error {
+	// a global store shares network configurations across hosts and makes the driver global scoped
+	if data, ok := option[netlabel.GlobalKVClient]; ok {
+		var err error
+		dsc, ok := data.(discoverapi.DatastoreConfigData)
+		if !ok {
+			return types.InternalErrorf("incorrect data in global datastore configuration: %v", data)
+		}
+		d.globalStore, err = datastore.NewDataStoreFromConfig(dsc)
+		if err != nil {
+			return types.InternalErrorf("ipvlan driver failed to initialize global data store: %v", err)
+		}
+		d.scope = GlobalScope
+	}
 	if data, ok := option[netlabel.LocalKVClient]; ok {
 		var err error
 		dsc, ok := data.(discoverapi.DatastoreConfigData)
@@ -55,16 +88,44 @@ func (d *driver) initStore(option map[string]interface{}) error {
 			return types.InternalErrorf("ipvlan driver failed to initialize data store: %v", err)
 		}
 
-		return d.populateNetworks()
+		if err := d.populateNetworks(); err != nil {
+			return err
+		}
+		if err := d.populateEndpoints(); err != nil {
+			return err
+		}
+		if err := d.populateLeases(); err != nil {
+			return err
+		}
+		if err := d.populateReservations(); err != nil {
+			return err
+		}
+
+		return d.reconcileLinks()
 	}
 
 	return nil
 }
 
+// StoreConfig returns the configuration of a libkv backed datastore, e.g. a
+// boltdb file for the local scope, suitable for the driver store options
+func StoreConfig(scope, provider, address string) discoverapi.DatastoreConfigData {
+	return discoverapi.DatastoreConfigData{
+		Scope:    scope,
+		Provider: provider,
+		Address:  address,
+		Config: &store.Config{
+			Bucket:            storeBucket,
+			ConnectionTimeout: storeTimeout,
+		},
+	}
+}
+
 // populateNetworks is invoked at driver init to recreate persistently stored networks
 func (d *driver) populateNetworks() error {
 	kvol, err := d.store.List(datastore.Key(ipvlanNetworkPrefix), &configuration{})
 	if err != nil && err != datastore.ErrKeyNotFound {
+		storeErrors.WithLabelValues("list").Inc()
 		return fmt.Errorf("failed to get ipvlan network configurations from store: %v", err)
 	}
 	// If empty it simply means no ipvlan networks have been created yet
@@ -73,17 +134,47 @@ func (d *driver) populateNetworks() error {
 	}
 	for _, kvo := range kvol {
 		config := kvo.(*configuration)
+		if d.parentLost(config) {
+			// the parent link can no longer be rebuilt, purge the stale record. Endpoints
+			// of the network are purged when they fail to find it in populateEndpoints
+			logrus.Warnf("parent %s of ipvlan network %s can not be rebuilt, removing it from persistent state", config.Parent, config.ID)
+			if err := d.storeDelete(config); err != nil {
+				logrus.Debugf("Failed to delete stale ipvlan network (%s) from store: %v", config.ID, err)
+			}
+			continue
+		}
 		if err = d.createNetwork(config); err != nil {
-			logrus.Warnf("could not create ipvlan network for id %s from persistent state", config.ID)
+			// keep the records of the network, the next restart retries it
+			logrus.Errorf("could not create ipvlan network for id %s from persistent state, keeping it: %v", config.ID, err)
+			d.unrestored[config.ID] = true
 		}
 	}
 
 	return nil
 }
 
+// parentLost reports whether the parent link of a stored network is missing and can not be
+// rebuilt: a missing parent the driver did not create, or a driver created parent that fails
+// to be recreated. Global scope parents are created lazily with the first endpoint
+func (d *driver) parentLost(config *configuration) bool {
+	if d.scope == GlobalScope || parentExists(config.Parent) {
+		return false
+	}
+	if !config.CreatedSlaveLink {
+		return true
+	}
+	if err := config.createParent(); err != nil {
+		logrus.Warnf("failed to recreate the parent %s of ipvlan network %s: %v", config.Parent, config.ID, err)
+		return true
+	}
+
+	return false
+}
+
 func (d *driver) populateEndpoints() error {
 	kvol, err := d.store.List(datastore.Key(ipvlanEndpointPrefix), &endpoint{})
 	if err != nil && err != datastore.ErrKeyNotFound {
+		storeErrors.WithLabelValues("list").Inc()
 		return fmt.Errorf("failed to get ipvlan endpoints from store: %v", err)
 	}
 
@@ -93,6 +184,9 @@ func (d *driver) populateEndpoints() error {
 
 	for _, kvo := range kvol {
 		ep := kvo.(*endpoint)
+		if d.unrestored[ep.nid] {
+			continue
+		}
 		n, ok := d.networks[ep.nid]
 		if !ok {
 			logrus.Debugf("Network (%s) not found for restored ipvlan endpoint (%s)", ep.nid[0:7], ep.id[0:7])
@@ -109,13 +203,40 @@ func (d *driver) populateEndpoints() error {
 	return nil
 }
 
+// getGlobalConfig fetches the network configuration shared by the swarm manager through the global store
+func (d *driver) getGlobalConfig(nid string) (*configuration, error) {
+	if d.globalStore == nil {
+		return nil, fmt.Errorf("ipvlan global store not initialized")
+	}
+	config := &configuration{ID: nid, scope: datastore.GlobalScope}
+	if err := d.globalStore.GetObject(datastore.Key(config.Key()...), config); err != nil {
+		if err != datastore.ErrKeyNotFound {
+			storeErrors.WithLabelValues("get").Inc()
+		}
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// storeFor returns the local or global store matching the data scope of the kv object
+func (d *driver) storeFor(kvObject datastore.KVObject) datastore.DataStore {
+	if kvObject.DataScope() == datastore.GlobalScope {
+		return d.globalStore
+	}
+
+	return d.store
+}
+
 // storeUpdate used to update persistent ipvlan network records as they are created
 func (d *driver) storeUpdate(kvObject datastore.KVObject) error {
-	if d.store == nil {
-		logrus.Warnf("ipvlan store not initialized. kv object %s is not added to the store", datastore.Key(kvObject.Key()...))
+	ds := d.storeFor(kvObject)
+	if ds == nil {
+		logrus.Warnf("ipvlan %s store not initialized. kv object %s is not added to the store", kvObject.DataScope(), datastore.Key(kvObject.Key()...))
 		return nil
 	}
-	if err := d.store.PutObjectAtomic(kvObject); err != nil {
+	if err := ds.PutObjectAtomic(kvObject); err != nil {
+		storeErrors.WithLabelValues("update").Inc()
 		return fmt.Errorf("failed to update ipvlan store for object type %T: %v", kvObject, err)
 	}
 
@@ -124,18 +245,21 @@ func (d *driver) storeUpdate(kvObject datastore.KVObject) error {
 
 // storeDelete used to delete ipvlan network records from persistent cache as they are deleted
 func (d *driver) storeDelete(kvObject datastore.KVObject) error {
-	if d.store == nil {
-		logrus.Debugf("ipvlan store not initialized. kv object %s is not deleted from store", datastore.Key(kvObject.Key()...))
+	ds := d.storeFor(kvObject)
+	if ds == nil {
+		logrus.Debugf("ipvlan %s store not initialized. kv object %s is not deleted from store", kvObject.DataScope(), datastore.Key(kvObject.Key()...))
 		return nil
 	}
 retry:
-	if err := d.store.DeleteObjectAtomic(kvObject); err != nil {
+	if err := ds.DeleteObjectAtomic(kvObject); err != nil {
 		if err == datastore.ErrKeyModified {
-			if err := d.store.GetObject(datastore.Key(kvObject.Key()...), kvObject); err != nil {
+			if err := ds.GetObject(datastore.Key(kvObject.Key()...), kvObject); err != nil {
+				storeErrors.WithLabelValues("delete").Inc()
 				return fmt.Errorf("could not update the kvobject to latest when trying to delete: %v", err)
 			}
 			goto retry
 		}
+		storeErrors.WithLabelValues("delete").Inc()
 		return err
 	}
 
@@ -148,7 +272,12 @@ func (config *configuration) MarshalJSON() ([]byte, error) {
 	nMap["Mtu"] = config.Mtu
 	nMap["Parent"] = config.Parent
 	nMap["IpvlanMode"] = config.IpvlanMode
+	nMap["IpvlanFlag"] = config.IpvlanFlag
 	nMap["Internal"] = config.Internal
+	nMap["Dhcp"] = config.Dhcp
+	nMap["DriverIpam"] = config.DriverIpam
+	nMap["HostAccess"] = config.HostAccess
+	nMap["HostAddress"] = config.HostAddress
 	nMap["CreatedSubIface"] = config.CreatedSlaveLink
 	if len(config.Ipv4Subnets) > 0 {
 		iis, err := json.Marshal(config.Ipv4Subnets)
@@ -164,6 +293,22 @@ func (config *configuration) MarshalJSON() ([]byte, error) {
 		}
 		nMap["Ipv6Subnets"] = string(iis)
 	}
+	if len(config.Routes) > 0 {
+		rs, err := json.Marshal(config.Routes)
+		if err != nil {
+			return nil, err
+		}
+		nMap["Routes"] = string(rs)
+	}
+	if len(config.DNS) > 0 {
+		nMap["DNS"] = config.DNS
+	}
+	if len(config.DNSSearch) > 0 {
+		nMap["DNSSearch"] = config.DNSSearch
+	}
+	if len(config.DNSOptions) > 0 {
+		nMap["DNSOptions"] = config.DNSOptions
+	}
 
 	return json.Marshal(nMap)
 }
@@ -181,7 +326,24 @@ func (config *configuration) UnmarshalJSON(b []byte) error {
 	config.Mtu = int(nMap["Mtu"].(float64))
 	config.Parent = nMap["Parent"].(string)
 	config.IpvlanMode = nMap["IpvlanMode"].(string)
+	// networks persisted before ipvlan flags were supported use the bridge default
+	if v, ok := nMap["IpvlanFlag"]; ok {
+		config.IpvlanFlag = v.(string)
+	}
+	if config.IpvlanFlag == "" {
+		config.IpvlanFlag = flagBridge
+	}
 	config.Internal = nMap["Internal"].(bool)
+	if v, ok := nMap["Dhcp"]; ok {
+		config.Dhcp = v.(bool)
+	}
+	if v, ok := nMap["DriverIpam"]; ok {
+		config.DriverIpam = v.(bool)
+	}
+	if v, ok := nMap["HostAccess"]; ok {
+		config.HostAccess = v.(bool)
+		config.HostAddress = nMap["HostAddress"].(string)
+	}
 	config.CreatedSlaveLink = nMap["CreatedSubIface"].(bool)
 	if v, ok := nMap["Ipv4Subnets"]; ok {
 		if err := json.Unmarshal([]byte(v.(string)), &config.Ipv4Subnets); err != nil {
@@ -193,6 +355,20 @@ func (config *configuration) UnmarshalJSON(b []byte) error {
 			return err
 		}
 	}
+	if v, ok := nMap["Routes"]; ok {
+		if err := json.Unmarshal([]byte(v.(string)), &config.Routes); err != nil {
+			return err
+		}
+	}
+	if v, ok := nMap["DNS"]; ok {
+		config.DNS = stringList(v)
+	}
+	if v, ok := nMap["DNSSearch"]; ok {
+		config.DNSSearch = stringList(v)
+	}
+	if v, ok := nMap["DNSOptions"]; ok {
+		config.DNSOptions = stringList(v)
+	}
 
 	return nil
 }
@@ -245,6 +421,10 @@ func (config *configuration) CopyTo(o datastore.KVObject) error {
 }
 
 func (config *configuration) DataScope() string {
+	// the shared copy of a global scope network lives in the global store
+	if config.scope != "" {
+		return config.scope
+	}
 	return datastore.LocalScope
 }
 
@@ -253,6 +433,7 @@ func (ep *endpoint) MarshalJSON() ([]byte, error) {
 	epMap["id"] = ep.id
 	epMap["nid"] = ep.nid
 	epMap["SrcName"] = ep.srcName
+	epMap["IfIndex"] = ep.ifIndex
 	if len(ep.mac) != 0 {
 		epMap["MacAddress"] = ep.mac.String()
 	}
@@ -262,6 +443,9 @@ func (ep *endpoint) MarshalJSON() ([]byte, error) {
 	if ep.addrv6 != nil {
 		epMap["Addrv6"] = ep.addrv6.String()
 	}
+	if ep.reservation != "" {
+		epMap["Reservation"] = ep.reservation
+	}
 	return json.Marshal(epMap)
 }
 
@@ -293,6 +477,12 @@ func (ep *endpoint) UnmarshalJSON(b []byte) error {
 	ep.id = epMap["id"].(string)
 	ep.nid = epMap["nid"].(string)
 	ep.srcName = epMap["SrcName"].(string)
+	if v, ok := epMap["IfIndex"]; ok {
+		ep.ifIndex = int(v.(float64))
+	}
+	if v, ok := epMap["Reservation"]; ok {
+		ep.reservation = v.(string)
+	}
 
 	return nil
 }
@@ -1,65 +1,374 @@
 package ipvlan
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
-	"github.com/docker/docker/plugin/getter"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/datastore"
 	"github.com/docker/libnetwork/driverapi"
-	_ "github.com/docker/libnetwork/testutils"
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/testutils"
+	"github.com/docker/libnetwork/types"
+	"github.com/vishvananda/netlink"
 )
 
-const testNetworkType = "ipvlan"
+const (
+	testNetworkType = "ipvlan"
+	testNetworkID   = "1b0fdc8ea6e8d6b4f5e44ab8aa8d4dbc6d9b34e1a2d18c1f48bc38d3cfa6e0e1"
+	testEndpointID  = "9e1a4d3c7f1b2a6e8c0d5f4b3a2e1d0c9b8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e"
+)
 
-type driverTester struct {
-	t *testing.T
-	d *driver
-}
+// newTestDriver returns a driver backed by a boltdb file inside dir
+func newTestDriver(t *testing.T, dir string) *driver {
+	config := map[string]interface{}{
+		netlabel.LocalKVClient: StoreConfig(datastore.LocalScope, "boltdb", filepath.Join(dir, "local-kv.db")),
+	}
+	d, err := NewDriver(config)
+	if err != nil {
+		t.Fatalf("failed to initialize the driver: %v", err)
+	}
 
-func (dt *driverTester) GetPluginGetter() getter.PluginGetter {
-	return nil
+	return d
 }
 
-func (dt *driverTester) RegisterDriver(name string, drv driverapi.Driver,
-	cap driverapi.Capability) error {
-	if name != testNetworkType {
-		dt.t.Fatalf("Expected driver register name to be %q. Instead got %q",
-			testNetworkType, name)
+// newTestNetworkRequest returns a create request for a network with the given v4 subnet
+func newTestNetworkRequest(t *testing.T, id, subnet string, options map[string]interface{}) *api.CreateNetworkRequest {
+	pool, err := types.ParseCIDR(subnet)
+	if err != nil {
+		t.Fatal(err)
 	}
+	gw := types.GetIPNetCopy(pool)
+	gw.IP = types.GetIPCopy(pool.IP)
+	gw.IP[len(gw.IP)-1]++
 
-	if _, ok := drv.(*driver); !ok {
-		dt.t.Fatalf("Expected driver type to be %T. Instead got %T",
-			&driver{}, drv)
+	return &api.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{netlabel.GenericData: options},
+		IPv4Data:  []driverapi.IPAMData{{Pool: pool, Gateway: gw}},
 	}
-
-	dt.d = drv.(*driver)
-	return nil
 }
 
 func TestIpvlanInit(t *testing.T) {
-	if err := Init(&driverTester{t: t}, nil); err != nil {
+	if _, err := NewDriver(nil); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestIpvlanNilConfig(t *testing.T) {
-	dt := &driverTester{t: t}
-	if err := Init(dt, nil); err != nil {
+	d, err := NewDriver(nil)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := dt.d.initStore(nil); err != nil {
+	if err := d.initStore(nil); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestIpvlanType(t *testing.T) {
-	dt := &driverTester{t: t}
-	if err := Init(dt, nil); err != nil {
+	d, err := NewDriver(nil)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if dt.d.Type() != testNetworkType {
+	if d.Type() != testNetworkType {
 		t.Fatalf("Expected Type() to return %q. Instead got %q", testNetworkType,
-			dt.d.Type())
+			d.Type())
+	}
+}
+
+// TestIpvlanStoreRestore tests networks and endpoints are restored from the store
+func TestIpvlanStoreRestore(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	dir, err := ioutil.TempDir("", "ipvlan-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newTestDriver(t, dir)
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "192.168.10.0/24", nil)); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.10.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+
+	// rebuild the driver from the same state directory
+	rd := newTestDriver(t, dir)
+	n, ok := rd.networks[testNetworkID]
+	if !ok {
+		t.Fatalf("network %s was not restored from the store", testNetworkID)
+	}
+	if n.config.Parent != getDummyName(testNetworkID[:12]) {
+		t.Fatalf("expected restored parent %s, got %s", getDummyName(testNetworkID[:12]), n.config.Parent)
+	}
+	if n.config.IpvlanMode != modeL2 {
+		t.Fatalf("expected restored ipvlan mode %s, got %s", modeL2, n.config.IpvlanMode)
+	}
+	if len(n.config.Ipv4Subnets) != 1 || n.config.Ipv4Subnets[0].SubnetIP != "192.168.10.0/24" {
+		t.Fatalf("unexpected restored ipv4 subnets: %v", n.config.Ipv4Subnets)
+	}
+	ep, ok := n.endpoints[testEndpointID]
+	if !ok {
+		t.Fatalf("endpoint %s was not restored from the store", testEndpointID)
+	}
+	if ep.addr == nil || !ep.addr.IP.Equal(net.ParseIP("192.168.10.2")) {
+		t.Fatalf("unexpected restored endpoint address: %v", ep.addr)
+	}
+
+	// deleted networks must not come back
+	if err := rd.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: testNetworkID}); err != nil {
+		t.Fatal(err)
+	}
+	rd = newTestDriver(t, dir)
+	if len(rd.networks) != 0 {
+		t.Fatalf("expected no networks after delete, found %d", len(rd.networks))
+	}
+}
+
+// TestRestoreLegacyFlag tests a network persisted before ipvlan flags were supported is
+// restored with the bridge flag and shares its parent with new bridge networks
+func TestRestoreLegacyFlag(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	dir, err := ioutil.TempDir("", "ipvlan-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dm-legacy"}}); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDriver(t, dir)
+	if err := d.CreateNetwork(newTestNetworkRequest(t, testNetworkID, "192.168.15.0/24", map[string]interface{}{parentOpt: "dm-legacy"})); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	// rewrite the record without the flag
+	config := d.networks[testNetworkID].config
+	var nMap map[string]interface{}
+	if err := json.Unmarshal(config.Value(), &nMap); err != nil {
+		t.Fatal(err)
+	}
+	delete(nMap, "IpvlanFlag")
+	b, err := json.Marshal(nMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.store.KVStore().Put(datastore.Key(config.Key()...), b, nil); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = newTestDriver(t, dir)
+	defer d.Close()
+	n, ok := d.networks[testNetworkID]
+	if !ok {
+		t.Fatalf("network %s was not restored from the store", testNetworkID)
+	}
+	if n.config.IpvlanFlag != flagBridge {
+		t.Fatalf("expected the restored flag %s, got %q", flagBridge, n.config.IpvlanFlag)
+	}
+	if err := d.CreateNetwork(newTestNetworkRequest(t, stringid.GenerateRandomID(), "192.168.16.0/24", map[string]interface{}{parentOpt: "dm-legacy"})); err != nil {
+		t.Fatalf("failed to share the parent of the restored network: %v", err)
+	}
+}
+
+// TestGlobalScope tests global networks are shared through the global store and
+// every host creates the parent link lazily with its first endpoint, the networks sharing
+// the parent delete it with the last of them
+func TestGlobalScope(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	dir, err := ioutil.TempDir("", "ipvlan-global")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newHost := func(name string) *driver {
+		d, err := NewDriver(map[string]interface{}{
+			netlabel.LocalKVClient:  StoreConfig(datastore.LocalScope, "boltdb", filepath.Join(dir, name, "local-kv.db")),
+			netlabel.GlobalKVClient: StoreConfig(datastore.GlobalScope, "boltdb", filepath.Join(dir, "global-kv.db")),
+		})
+		if err != nil {
+			t.Fatalf("failed to initialize the %s driver: %v", name, err)
+		}
+		return d
+	}
+	manager := newHost("manager")
+	worker := newHost("worker")
+
+	caps, err := worker.GetCapabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Scope != GlobalScope {
+		t.Fatalf("expected %s scope, got %s", GlobalScope, caps.Scope)
+	}
+
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dm-global"}}); err != nil {
+		t.Fatal(err)
+	}
+	parent := "dm-global.40"
+	req := newTestNetworkRequest(t, testNetworkID, "192.168.40.0/24", nil)
+	opts, err := manager.NetworkAllocate(testNetworkID, map[string]string{parentOpt: parent, driverModeOpt: modeL3}, req.IPv4Data, nil)
+	if err != nil {
+		t.Fatalf("failed to allocate network: %v", err)
+	}
+	if opts[driverModeOpt] != modeL3 || opts[driverFlagOpt] != flagBridge {
+		t.Fatalf("unexpected allocated options: %v", opts)
+	}
+
+	// the worker inherits the options missing from its request from the shared configuration
+	if err := worker.CreateNetwork(req); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	n := worker.network(testNetworkID)
+	if n.config.Parent != parent || n.config.IpvlanMode != modeL3 {
+		t.Fatalf("expected parent %s in mode %s, got %s in mode %s", parent, modeL3, n.config.Parent, n.config.IpvlanMode)
+	}
+	if parentExists(parent) {
+		t.Fatalf("parent %s should not be created before the first endpoint", parent)
+	}
+	// a second network lazily shares the parent created for the first one
+	shared := stringid.GenerateRandomID()
+	sharedReq := newTestNetworkRequest(t, shared, "192.168.41.0/24", map[string]interface{}{parentOpt: parent, driverModeOpt: modeL3})
+	if err := worker.CreateNetwork(sharedReq); err != nil {
+		t.Fatalf("failed to create network: %v", err)
+	}
+	_, err = worker.CreateEndpoint(&api.CreateEndpointRequest{
+		NetworkID:  testNetworkID,
+		EndpointID: testEndpointID,
+		Interface:  &api.EndpointInterface{Address: "192.168.40.2/24"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create endpoint: %v", err)
+	}
+	if !parentExists(parent) || !n.config.CreatedSlaveLink {
+		t.Fatalf("parent %s was not created with the first endpoint", parent)
+	}
+	if !worker.network(shared).config.CreatedSlaveLink {
+		t.Fatalf("network sharing parent %s does not hold a reference to it", parent)
+	}
+	// the last network using the parent deletes it
+	if err := worker.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+		t.Fatalf("failed to delete endpoint: %v", err)
+	}
+	if err := worker.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: testNetworkID}); err != nil {
+		t.Fatalf("failed to delete network: %v", err)
+	}
+	if !parentExists(parent) {
+		t.Fatalf("parent %s was deleted while another network uses it", parent)
+	}
+	if err := worker.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: shared}); err != nil {
+		t.Fatalf("failed to delete network: %v", err)
+	}
+	if parentExists(parent) {
+		t.Fatalf("parent %s was not deleted with the last network", parent)
+	}
+
+	if err := manager.NetworkFree(testNetworkID); err != nil {
+		t.Fatalf("failed to free network: %v", err)
+	}
+	if _, err := worker.getGlobalConfig(testNetworkID); err == nil {
+		t.Fatal("shared configuration was not removed by NetworkFree")
+	}
+}
+
+// TestIPv6Only tests networks and endpoints without ipv4 addressing
+func TestIPv6Only(t *testing.T) {
+	defer testutils.SetupTestOSContext(t)()
+
+	dir, err := ioutil.TempDir("", "ipvlan-v6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parent := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dm-v6"}}
+	if err := netlink.LinkAdd(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(parent); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := types.ParseCIDR("2001:db8:10::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := types.ParseCIDR("2001:db8:10::1/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDriver(t, dir)
+	for _, mode := range []string{modeL2, modeL3} {
+		err := d.CreateNetwork(&api.CreateNetworkRequest{
+			NetworkID: testNetworkID,
+			Options:   map[string]interface{}{netlabel.GenericData: map[string]interface{}{parentOpt: "dm-v6", driverModeOpt: mode}},
+			IPv6Data:  []driverapi.IPAMData{{Pool: pool, Gateway: gw}},
+		})
+		if err != nil {
+			t.Fatalf("failed to create an ipv6-only %s network: %v", mode, err)
+		}
+		_, err = d.CreateEndpoint(&api.CreateEndpointRequest{
+			NetworkID:  testNetworkID,
+			EndpointID: testEndpointID,
+			Interface:  &api.EndpointInterface{AddressIPv6: "2001:db8:10::2/64"},
+		})
+		if err != nil {
+			t.Fatalf("failed to create an ipv6-only endpoint: %v", err)
+		}
+		res, err := d.Join(&api.JoinRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+		if err != nil {
+			t.Fatalf("failed to join: %v", err)
+		}
+		if res.Gateway != "" {
+			t.Fatalf("unexpected ipv4 gateway %q in mode %s", res.Gateway, mode)
+		}
+		switch mode {
+		case modeL2:
+			if res.GatewayIPv6 != "2001:db8:10::1" || len(res.StaticRoutes) != 0 {
+				t.Fatalf("unexpected l2 join info: gateway %q, routes %v", res.GatewayIPv6, res.StaticRoutes)
+			}
+		case modeL3:
+			if len(res.StaticRoutes) != 1 || res.StaticRoutes[0] != defaultV6Route {
+				t.Fatalf("expected only the v6 default route in l3 mode, got %v", res.StaticRoutes)
+			}
+		}
+
+		// the endpoint without ipv4 address survives a restart
+		rd := newTestDriver(t, dir)
+		ep := rd.network(testNetworkID).endpoint(testEndpointID)
+		if ep == nil || ep.addr != nil || ep.addrv6 == nil || ep.addrv6.String() != "2001:db8:10::2/64" {
+			t.Fatalf("unexpected restored ipv6-only endpoint: %+v", ep)
+		}
+		rd.Close()
+
+		if err := d.Leave(&api.LeaveRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.DeleteEndpoint(&api.DeleteEndpointRequest{NetworkID: testNetworkID, EndpointID: testEndpointID}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.DeleteNetwork(&api.DeleteNetworkRequest{NetworkID: testNetworkID}); err != nil {
+			t.Fatal(err)
+		}
 	}
 }
@@ -0,0 +1,129 @@
+package ipvlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// PluginSockDir is the directory docker discovers plugin unix sockets in
+	PluginSockDir = "/run/docker/plugins"
+	// PluginSpecDir is the directory docker discovers plugin spec files in
+	PluginSpecDir = "/etc/docker/plugins"
+)
+
+// pluginSockDir and pluginSpecDir are the plugin directories in use, tests point them elsewhere
+var (
+	pluginSockDir = PluginSockDir
+	pluginSpecDir = PluginSpecDir
+)
+
+// NewUnixListener listens on the unix socket path, replacing a stale socket left by a
+// previous plugin instance, and hands the socket to the group
+func NewUnixListener(path, group string) (net.Listener, error) {
+	gid, err := lookupGid(group)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the socket directory of %s: %v", path, err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chown(path, -1, gid); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set the group of %s to %s: %v", path, group, err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set the permissions of %s: %v", path, err)
+	}
+
+	return l, nil
+}
+
+// NewTCPListener listens on the tcp address and writes the plugin spec file docker
+// uses to discover the plugin by name, returning the listener and the spec path
+func NewTCPListener(name, addr string) (net.Listener, string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	spec, err := writeSpec(name, "tcp://"+l.Addr().String())
+	if err != nil {
+		l.Close()
+		return nil, "", err
+	}
+
+	return l, spec, nil
+}
+
+// WriteUnixSpec writes the plugin spec file docker uses to discover a plugin whose unix
+// socket is not PluginSockDir/<name>.sock, returning the spec path
+func WriteUnixSpec(name, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the socket path %s: %v", path, err)
+	}
+	return writeSpec(name, "unix://"+abs)
+}
+
+// writeSpec writes the address of the plugin to its spec file
+func writeSpec(name, addr string) (string, error) {
+	if err := os.MkdirAll(pluginSpecDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create the plugin spec directory %s: %v", pluginSpecDir, err)
+	}
+	spec := filepath.Join(pluginSpecDir, name+".spec")
+	if err := ioutil.WriteFile(spec, []byte(addr), 0644); err != nil {
+		return "", fmt.Errorf("failed to write the plugin spec file %s: %v", spec, err)
+	}
+
+	return spec, nil
+}
+
+// removeStaleSocket deletes a socket file no process is listening on anymore
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	// a socket still accepting connections belongs to another running instance
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another plugin instance", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove the stale socket %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// lookupGid resolves a group name or numeric id to a group id
+func lookupGid(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up group %s: %v", group, err)
+	}
+
+	return strconv.Atoi(g.Gid)
+}
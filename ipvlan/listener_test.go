@@ -0,0 +1,75 @@
+package ipvlan
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// TestUnixListenerStaleSocket tests a stale socket is replaced but a live one is not
+func TestUnixListenerStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvlan-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipvlan.sock")
+	group := strconv.Itoa(os.Getgid())
+
+	// leave a socket file behind without a listener
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := NewUnixListener(path, group)
+	if err != nil {
+		t.Fatalf("failed to replace the stale socket: %v", err)
+	}
+	defer l.Close()
+
+	// a second instance must not steal the socket of the running one
+	if _, err := NewUnixListener(path, group); err == nil {
+		t.Fatal("expected an error listening on a socket in use")
+	}
+
+	// a regular file is never removed
+	file := filepath.Join(dir, "ipvlan.file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewUnixListener(file, group); err == nil {
+		t.Fatal("expected an error listening on a regular file")
+	}
+}
+
+// TestUnixSpec tests a socket outside of the plugin directory is discoverable by name
+func TestUnixSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvlan-spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { pluginSpecDir = orig }(pluginSpecDir)
+	pluginSpecDir = filepath.Join(dir, "plugins")
+
+	spec, err := WriteUnixSpec("ipvlan-canary", filepath.Join(dir, "canary.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec != filepath.Join(pluginSpecDir, "ipvlan-canary.spec") {
+		t.Fatalf("unexpected spec file %s", spec)
+	}
+	b, err := ioutil.ReadFile(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "unix://" + filepath.Join(dir, "canary.sock"); string(b) != expected {
+		t.Fatalf("expected spec %q, got %q", expected, b)
+	}
+}
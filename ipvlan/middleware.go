@@ -0,0 +1,213 @@
+package ipvlan
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/libnetwork/types"
+)
+
+const (
+	// RequestIDHeader carries the correlation id of a plugin request, an id is generated
+	// when the client does not pass one
+	RequestIDHeader = "X-Request-Id"
+	// DefaultOperationTimeout bounds the read-only driver calls without a specific timeout
+	DefaultOperationTimeout = 20 * time.Second
+)
+
+// Middleware wraps the handler of a plugin path, e.g. to log or authorize the requests
+type Middleware func(path string, next http.HandlerFunc) http.HandlerFunc
+
+type requestIDKey struct{}
+
+// statefulPaths change links, leases, reservations or store records. Docker treats a timed
+// out call as failed while the driver would still complete it, so they are never timed out
+// here. Their slow steps are bounded inside the driver instead, e.g. each dhcp exchange
+// gives up after dhcpTimeout and the endpoint create is rolled back
+var statefulPaths = map[string]bool{
+	createNetworkPath:  true,
+	deleteNetworkPath:  true,
+	createEndpointPath: true,
+	deleteEndpointPath: true,
+	joinPath:           true,
+	leavePath:          true,
+	allocateNetPath:    true,
+	freeNetPath:        true,
+	requestPoolPath:    true,
+	releasePoolPath:    true,
+	requestAddressPath: true,
+	releaseAddressPath: true,
+}
+
+// Use appends middlewares to the chain wrapping every plugin path. The built-in chain
+// assigns the request id, logs the request and its latency, records the request metrics,
+// times out the read-only calls and recovers from panics, the middlewares passed here run innermost
+func (h *Handler) Use(m ...Middleware) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.middlewares = append(h.middlewares, m...)
+}
+
+// SetTimeout sets the timeout of the read-only driver call served on the plugin path. The
+// calls changing the driver state are never timed out, their timeout is ignored
+func (h *Handler) SetTimeout(path string, timeout time.Duration) {
+	if statefulPaths[path] {
+		logrus.Warnf("Ignoring the timeout of %s, driver calls changing state are never timed out", path)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.timeouts[path] = timeout
+}
+
+func (h *Handler) operationTimeout(path string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if timeout, ok := h.timeouts[path]; ok {
+		return timeout
+	}
+	return DefaultOperationTimeout
+}
+
+// chain wraps fn with the built-in middlewares and the middlewares passed to Use
+func (h *Handler) chain(path string, fn http.HandlerFunc) http.HandlerFunc {
+	h.mu.Lock()
+	chain := append([]Middleware{withRequestID, withLogging, withMetrics, h.withTimeout, withRecovery}, h.middlewares...)
+	h.mu.Unlock()
+	for i := len(chain) - 1; i >= 0; i-- {
+		fn = chain[i](path, fn)
+	}
+	return fn
+}
+
+// requestID returns the correlation id of the request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID tags the request and its response with a correlation id
+func withRequestID(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = stringid.TruncateID(stringid.GenerateNonCryptoID())
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// statusRecorder records the status of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// withLogging logs every request with its status and latency
+func withLogging(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		entry := logrus.WithFields(logrus.Fields{
+			"request":  requestID(r),
+			"path":     path,
+			"status":   rec.status,
+			"duration": time.Since(start),
+		})
+		if rec.status >= http.StatusInternalServerError {
+			entry.Warn("plugin request failed")
+		} else {
+			entry.Debug("plugin request served")
+		}
+	}
+}
+
+// bufferedResponse holds the response of a driver call until it completes in time
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// withTimeout answers with a timeout error when a read-only driver call does not complete
+// within the operation timeout, the call itself runs to completion and its response is
+// dropped. Drain keeps waiting for the timed out calls
+func (h *Handler) withTimeout(path string, next http.HandlerFunc) http.HandlerFunc {
+	if statefulPaths[path] {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := h.operationTimeout(path)
+		res := &bufferedResponse{header: http.Header{}}
+		done := make(chan struct{})
+		h.inflight.Add(1)
+		go func() {
+			defer h.inflight.Done()
+			defer close(done)
+			next(res, r)
+		}()
+		select {
+		case <-done:
+			for k, v := range res.header {
+				w.Header()[k] = v
+			}
+			if res.status != 0 {
+				w.WriteHeader(res.status)
+			}
+			w.Write(res.body.Bytes())
+		case <-time.After(timeout):
+			encodeError(w, types.TimeoutErrorf("%s did not complete within %v", path, timeout))
+		}
+	}
+}
+
+// withRecovery turns a panic of the driver call into an internal error response
+func withRecovery(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				logrus.WithFields(logrus.Fields{"request": requestID(r), "path": path}).Errorf("plugin request panicked: %v\n%s", p, debug.Stack())
+				encodeError(w, types.InternalErrorf("%s failed: %v", path, p))
+			}
+		}()
+		next(w, r)
+	}
+}
@@ -0,0 +1,142 @@
+package ipvlan
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/types"
+)
+
+// slowDriver panics on DeleteNetwork and blocks CreateNetwork and EndpointOperInfo until
+// release is closed
+type slowDriver struct {
+	fakeDriver
+	release chan struct{}
+}
+
+func (d *slowDriver) CreateNetwork(r *api.CreateNetworkRequest) error {
+	<-d.release
+	return d.record(r)
+}
+
+func (d *slowDriver) DeleteNetwork(r *api.DeleteNetworkRequest) error {
+	panic("boom")
+}
+
+func (d *slowDriver) EndpointOperInfo(r *api.EndpointInfoRequest) (*api.EndpointInfoResponse, error) {
+	<-d.release
+	return &api.EndpointInfoResponse{}, d.record(r)
+}
+
+// TestMiddlewareRecovery tests a panicking driver call is answered with an internal error
+// and the handler keeps serving
+func TestMiddlewareRecovery(t *testing.T) {
+	h := NewHandler(&slowDriver{release: make(chan struct{})})
+	url, stop := serveTestHandler(h)
+	defer stop()
+
+	status, body := postTestRequest(t, url, deleteNetworkPath, &api.DeleteNetworkRequest{NetworkID: testNetworkID})
+	expectErrorResponse(t, deleteNetworkPath, status, body, types.InternalErrorf("%s failed: boom", deleteNetworkPath),
+		http.StatusInternalServerError, errClassInternal)
+
+	// the handler keeps serving after a panic
+	status, _ = postTestRequest(t, url, leavePath, &api.LeaveRequest{NetworkID: testNetworkID})
+	if status != http.StatusOK {
+		t.Fatalf("expected status %d after a recovered panic, got %d", http.StatusOK, status)
+	}
+}
+
+// TestMiddlewareTimeout tests only read-only driver calls are timed out, a call changing
+// the driver state is answered once it completes
+func TestMiddlewareTimeout(t *testing.T) {
+	d := &slowDriver{release: make(chan struct{})}
+	h := NewHandler(d)
+	h.SetTimeout(endpointInfoPath, 50*time.Millisecond)
+	h.SetTimeout(createNetworkPath, 50*time.Millisecond)
+	if timeout := h.operationTimeout(createNetworkPath); timeout != DefaultOperationTimeout {
+		t.Fatalf("expected the timeout of a stateful path to be ignored, got %v", timeout)
+	}
+	url, stop := serveTestHandler(h)
+	defer stop()
+
+	status, body := postTestRequest(t, url, endpointInfoPath, &api.EndpointInfoRequest{NetworkID: testNetworkID, EndpointID: testEndpointID})
+	expectErrorResponse(t, endpointInfoPath, status, body,
+		types.TimeoutErrorf("%s did not complete within %v", endpointInfoPath, 50*time.Millisecond),
+		http.StatusServiceUnavailable, errClassRetry)
+
+	created := make(chan int, 1)
+	go func() {
+		res, err := http.Post(url+createNetworkPath, "application/json", strings.NewReader(`{"NetworkID":"`+testNetworkID+`"}`))
+		if err != nil {
+			created <- 0
+			return
+		}
+		res.Body.Close()
+		created <- res.StatusCode
+	}()
+	select {
+	case status := <-created:
+		t.Fatalf("expected the create network call to wait for the driver, got status %d", status)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(d.release)
+	if status := <-created; status != http.StatusOK {
+		t.Fatalf("expected status %d once the driver completed, got %d", http.StatusOK, status)
+	}
+	if err := h.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMiddlewareRequestID tests the request id is taken from the client or generated, and
+// is handed to the middlewares and echoed in the response
+func TestMiddlewareRequestID(t *testing.T) {
+	h := NewHandler(&fakeDriver{})
+	var (
+		mu  sync.Mutex
+		ids []string
+	)
+	h.Use(func(path string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			ids = append(ids, requestID(r))
+			mu.Unlock()
+			next(w, r)
+		}
+	})
+	url, stop := serveTestHandler(h)
+	defer stop()
+
+	req, err := http.NewRequest("POST", url+leavePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(RequestIDHeader, "abc")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if id := res.Header.Get(RequestIDHeader); id != "abc" {
+		t.Fatalf("expected the client request id in the response, got %q", id)
+	}
+
+	res, err = http.Post(url+leavePath, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	id := res.Header.Get(RequestIDHeader)
+	if id == "" || id == "abc" {
+		t.Fatalf("expected a generated request id, got %q", id)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 2 || ids[0] != "abc" || ids[1] != id {
+		t.Fatalf("expected the middleware to see the request ids [abc %s], got %v", id, ids)
+	}
+}
@@ -2,32 +2,257 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/coderplay/ipvlan/ipvlan"
+	"github.com/docker/libnetwork/datastore"
+	"github.com/docker/libnetwork/netlabel"
 )
 
 func main() {
 
 	var (
-		debug            bool
-		address          string
+		debug      bool
+		address    string
+		tcpAddress string
+		name       string
+		group      string
+		stateDir   string
+		scope      string
+		kvProvider string
+		kvAddress  string
+		logLevel   string
+		levelFile  string
+		timeout    time.Duration
+		bgpAS      uint
+		bgpID      string
+		bgpNextHop string
+		peers      bgpPeers
+		metrics    string
+		admin      string
 	)
 
 	flag.BoolVar(&debug, "debug", false, "enable debugging")
-	flag.StringVar(&address, "socket", "/run/docker/plugins/ipvlan.sock", "socket on which to listen")
+	flag.StringVar(&logLevel, "log-level", "info", "log level, overridden by -debug")
+	flag.StringVar(&levelFile, "log-level-file", "", "file holding the log level reloaded on SIGHUP")
+	flag.DurationVar(&timeout, "shutdown-timeout", 30*time.Second, "time to wait for in-flight requests on shutdown")
+	flag.StringVar(&address, "socket", "", "unix socket on which to listen, defaults to "+ipvlan.PluginSockDir+"/<name>.sock, other paths get a spec file in "+ipvlan.PluginSpecDir)
+	flag.StringVar(&tcpAddress, "tcp", "", "tcp address on which to listen instead of the unix socket")
+	flag.StringVar(&name, "name", "ipvlan", "plugin name docker uses to discover the driver")
+	flag.StringVar(&group, "group", "root", "group owning the unix socket")
+	flag.StringVar(&stateDir, "state-dir", "/var/lib/docker-ipvlan", "directory holding the persistent driver state")
+	flag.StringVar(&scope, "scope", ipvlan.LocalScope, "driver scope, local or global for swarm-wide networks")
+	flag.StringVar(&kvProvider, "kv-provider", "consul", "key/value store sharing global networks (consul, etcd, zk or boltdb)")
+	flag.StringVar(&kvAddress, "kv-address", "", "address of the key/value store sharing global networks")
+	flag.UintVar(&bgpAS, "bgp-as", 0, "local as of the bgp speaker announcing the l3 endpoint prefixes")
+	flag.StringVar(&bgpID, "bgp-router-id", "", "ipv4 router id of the bgp speaker")
+	flag.StringVar(&bgpNextHop, "bgp-next-hop", "", "next hop of the announced prefixes, defaults to the router id")
+	flag.Var(&peers, "bgp-peer", "bgp peer as <as>@<address>[:port], repeat for several peers")
+	flag.StringVar(&metrics, "metrics-listen", "", "tcp address serving the prometheus metrics on /metrics, disabled when empty")
+	flag.StringVar(&admin, "admin-socket", "", "unix socket serving the admin api, outside of "+ipvlan.PluginSockDir+", disabled when empty")
 
 	flag.Parse()
 
 	if debug {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+		logLevel = log.DebugLevel.String()
+	}
+	if err := setLogLevel(logLevel); err != nil {
+		log.Fatal(err)
 	}
 
-	d := ipvlan.NewDriver()
+	config := map[string]interface{}{
+		netlabel.LocalKVClient: ipvlan.StoreConfig(datastore.LocalScope, "boltdb", filepath.Join(stateDir, "local-kv.db")),
+	}
+	switch scope {
+	case ipvlan.LocalScope:
+	case ipvlan.GlobalScope:
+		if kvAddress == "" {
+			log.Fatalf("-kv-address is required by the %s scope", scope)
+		}
+		config[netlabel.GlobalKVClient] = ipvlan.StoreConfig(datastore.GlobalScope, kvProvider, kvAddress)
+	default:
+		log.Fatalf("invalid scope %q, must be %s or %s", scope, ipvlan.LocalScope, ipvlan.GlobalScope)
+	}
+	if len(peers) > 0 {
+		if bgpAS == 0 || bgpAS > 1<<32-1 {
+			log.Fatalf("-bgp-as must be a valid as number when -bgp-peer is set")
+		}
+		config[ipvlan.BGPOption] = &ipvlan.BGPConfig{
+			LocalAS:  uint32(bgpAS),
+			RouterID: net.ParseIP(bgpID),
+			NextHop:  net.ParseIP(bgpNextHop),
+			Peers:    peers,
+		}
+	}
+	d, err := ipvlan.NewDriver(config)
+	if err != nil {
+		log.Fatalf("Failed to initialize the ipvlan driver: %v", err)
+	}
 	h := ipvlan.NewHandler(d)
-	if err := h.ServeUnix("root", "ipvlan"); err != nil {
-		log.Fatalf("Server down %v", err)
+	if metrics != "" {
+		ml, err := net.Listen("tcp", metrics)
+		if err != nil {
+			log.Fatalf("Failed to listen on the metrics address %s: %v", metrics, err)
+		}
+		go func() {
+			log.Errorf("Metrics server down %v", http.Serve(ml, ipvlan.NewMetricsHandler(d)))
+		}()
+		log.Infof("Serving metrics on http://%s/metrics", ml.Addr())
+	}
+	if admin != "" {
+		al, err := ipvlan.NewAdminListener(admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Errorf("Admin server down %v", http.Serve(al, ipvlan.NewAdminHandler(d)))
+		}()
+		log.Infof("Serving the admin api on unix://%s", admin)
+	}
+
+	var (
+		l       net.Listener
+		cleanup []string // socket and spec files removed on exit
+	)
+	if tcpAddress != "" {
+		var spec string
+		l, spec, err = ipvlan.NewTCPListener(name, tcpAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cleanup = append(cleanup, spec)
+		log.Infof("Plugin %s listening on tcp://%s, spec file %s", name, l.Addr(), spec)
+	} else {
+		if address == "" {
+			address = filepath.Join(ipvlan.PluginSockDir, name+".sock")
+		}
+		l, err = ipvlan.NewUnixListener(address, group)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cleanup = append(cleanup, address)
+		log.Infof("Plugin %s listening on unix://%s", name, address)
+		// docker only discovers the sockets of the plugin directory by name
+		if address != filepath.Join(ipvlan.PluginSockDir, name+".sock") {
+			spec, err := ipvlan.WriteUnixSpec(name, address)
+			if err != nil {
+				l.Close()
+				log.Fatal(err)
+			}
+			cleanup = append(cleanup, spec)
+			log.Infof("Plugin %s spec file %s", name, spec)
+		}
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- h.Serve(l)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-serveErr:
+			log.Errorf("Server down %v", err)
+			d.Close()
+			removeFiles(cleanup)
+			os.Exit(1)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadLogLevel(levelFile)
+				continue
+			}
+			log.Infof("Received %v, shutting down", sig)
+			os.Exit(shutdown(l, h, d, cleanup, timeout))
+		}
+	}
+}
+
+// shutdown stops accepting requests, waits for the in-flight driver calls, closes the
+// datastores and removes the socket and spec files, returning the process exit status. The
+// driver is not closed when the in-flight calls do not complete in time
+func shutdown(l net.Listener, h *ipvlan.Handler, d io.Closer, cleanup []string, timeout time.Duration) int {
+	l.Close()
+	// driver calls still running would fail halfway through their store writes, the
+	// datastores are left open and released by the exit instead
+	if err := h.Drain(timeout); err != nil {
+		log.Errorf("Failed to drain the plugin requests, exiting without closing the driver: %v", err)
+		removeFiles(cleanup)
+		return 1
 	}
-}
\ No newline at end of file
+	status := 0
+	if err := d.Close(); err != nil {
+		log.Errorf("Failed to close the driver: %v", err)
+		status = 1
+	}
+	removeFiles(cleanup)
+	log.Infof("Shutdown complete")
+
+	return status
+}
+
+// removeFiles removes the socket and spec files of the plugin
+func removeFiles(files []string) {
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove %s: %v", f, err)
+		}
+	}
+}
+
+// setLogLevel parses and applies a logrus level name
+func setLogLevel(level string) error {
+	lvl, err := log.ParseLevel(strings.TrimSpace(level))
+	if err != nil {
+		return err
+	}
+	log.SetLevel(lvl)
+
+	return nil
+}
+
+// reloadLogLevel applies the log level held in the level file on SIGHUP
+func reloadLogLevel(levelFile string) {
+	if levelFile == "" {
+		log.Warnf("Received SIGHUP without a -log-level-file, keeping log level %s", log.GetLevel())
+		return
+	}
+	b, err := ioutil.ReadFile(levelFile)
+	if err != nil {
+		log.Errorf("Failed to read the log level file %s: %v", levelFile, err)
+		return
+	}
+	if err := setLogLevel(string(b)); err != nil {
+		log.Errorf("Invalid log level in %s: %v", levelFile, err)
+		return
+	}
+	log.Infof("Log level reloaded to %s", log.GetLevel())
+}
+
+// bgpPeers collects the repeated -bgp-peer flags
+type bgpPeers []ipvlan.BGPPeer
+
+func (p *bgpPeers) String() string {
+	return fmt.Sprint(*p)
+}
+
+func (p *bgpPeers) Set(value string) error {
+	peer, err := ipvlan.ParseBGPPeer(value)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, peer)
+
+	return nil
+}